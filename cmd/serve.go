@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"github.com/IguteChung/flakbase/pkg/net"
@@ -11,6 +13,31 @@ var (
 	flagPort  string
 	flagMongo string
 	flagRule  string
+
+	flagMaxFrameSize int
+	flagIdleTimeout  time.Duration
+
+	flagCompression        bool
+	flagCompressionLevel   int
+	flagCompressionMinSize int
+
+	flagMaxQueueSize int
+	flagSlowConsumer string
+
+	flagCoalesceWindow   time.Duration
+	flagCoalesceMaxDelay time.Duration
+
+	flagMaxBodySize int64
+
+	flagCORSOrigins []string
+	flagCORSMethods []string
+	flagCORSHeaders []string
+
+	flagNamespaces    []string
+	flagMaxNamespaces int
+
+	flagRedirects  map[string]string
+	flagAdminToken string
 )
 
 var cmdServe = &cobra.Command{
@@ -24,6 +51,23 @@ func init() {
 	cmdServe.Flags().StringVarP(&flagHost, "host", "", "localhost:9527", "host name to serve")
 	cmdServe.Flags().StringVarP(&flagMongo, "mongo", "m", "", "mongodb config file")
 	cmdServe.Flags().StringVarP(&flagRule, "rule", "", "", "security rule json file")
+	cmdServe.Flags().IntVarP(&flagMaxFrameSize, "max-frame-size", "", net.DefaultMaxFrameSize, "max size of an outgoing websocket frame")
+	cmdServe.Flags().DurationVarP(&flagIdleTimeout, "idle-timeout", "", net.DefaultIdleTimeout, "duration to close a silent websocket connection")
+	cmdServe.Flags().BoolVarP(&flagCompression, "compression", "", false, "enable websocket permessage-deflate compression")
+	cmdServe.Flags().IntVarP(&flagCompressionLevel, "compression-level", "", net.DefaultCompressionLevel, "flate level to compress websocket frames")
+	cmdServe.Flags().IntVarP(&flagCompressionMinSize, "compression-min-size", "", net.DefaultCompressionMinSize, "min size of a websocket frame to compress")
+	cmdServe.Flags().IntVarP(&flagMaxQueueSize, "max-queue-size", "", net.DefaultMaxQueueSize, "max number of pending outgoing messages of a connection")
+	cmdServe.Flags().StringVarP(&flagSlowConsumer, "slow-consumer", "", net.SlowConsumerCoalesce, "policy for a full outbound queue, coalesce or disconnect")
+	cmdServe.Flags().DurationVarP(&flagCoalesceWindow, "coalesce-window", "", 0, "duration to merge listener notifications during write bursts")
+	cmdServe.Flags().DurationVarP(&flagCoalesceMaxDelay, "coalesce-max-delay", "", 0, "max duration to postpone a listener notification")
+	cmdServe.Flags().Int64VarP(&flagMaxBodySize, "max-body-size", "", net.DefaultMaxBodySize, "max size of a restful request body in bytes")
+	cmdServe.Flags().StringSliceVarP(&flagCORSOrigins, "cors-origin", "", nil, "origins allowed for cross origin requests and websocket, any origin if empty")
+	cmdServe.Flags().StringSliceVarP(&flagCORSMethods, "cors-method", "", nil, "methods allowed for cross origin requests")
+	cmdServe.Flags().StringSliceVarP(&flagCORSHeaders, "cors-header", "", nil, "headers allowed for cross origin requests")
+	cmdServe.Flags().StringSliceVarP(&flagNamespaces, "namespace", "", nil, "namespaces allowed besides the default one, any namespace if empty")
+	cmdServe.Flags().IntVarP(&flagMaxNamespaces, "max-namespaces", "", net.DefaultMaxNamespaces, "max number of namespaces including the default one")
+	cmdServe.Flags().StringToStringVarP(&flagRedirects, "redirect", "", nil, "redirect namespaces to other hosts, e.g. ns1=host1:9527")
+	cmdServe.Flags().StringVarP(&flagAdminToken, "admin-token", "", "", "bearer token to enable admin api")
 }
 
 func serve(cmd *cobra.Command, args []string) {
@@ -31,5 +75,30 @@ func serve(cmd *cobra.Command, args []string) {
 		Host:  flagHost,
 		Rule:  flagRule,
 		Mongo: flagMongo,
+
+		MaxFrameSize: flagMaxFrameSize,
+		IdleTimeout:  flagIdleTimeout,
+
+		Compression:        flagCompression,
+		CompressionLevel:   flagCompressionLevel,
+		CompressionMinSize: flagCompressionMinSize,
+
+		MaxQueueSize: flagMaxQueueSize,
+		SlowConsumer: flagSlowConsumer,
+
+		CoalesceWindow:   flagCoalesceWindow,
+		CoalesceMaxDelay: flagCoalesceMaxDelay,
+
+		MaxBodySize: flagMaxBodySize,
+
+		CORSOrigins: flagCORSOrigins,
+		CORSMethods: flagCORSMethods,
+		CORSHeaders: flagCORSHeaders,
+
+		Namespaces:    flagNamespaces,
+		MaxNamespaces: flagMaxNamespaces,
+
+		Redirects:  flagRedirects,
+		AdminToken: flagAdminToken,
 	})
 }
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrorKind defines the category of an error to be reported to clients.
+type ErrorKind int
+
+const (
+	// KindInternal implies a server fault.
+	KindInternal ErrorKind = iota
+	// KindInvalid implies an invalid request, such as bad query, key or JSON.
+	KindInvalid
+	// KindPermission implies the request is not permitted.
+	KindPermission
+	// KindNotFound implies the requested resource does not exist.
+	KindNotFound
+	// KindMethod implies the method is not allowed.
+	KindMethod
+	// KindTooLarge implies the request exceeds the size limit.
+	KindTooLarge
+	// KindUnsupported implies the request is not supported by the server deployment.
+	KindUnsupported
+	// KindTimeout implies the request exceeds its deadline.
+	KindTimeout
+)
+
+// Error defines an error with kind, so that clients can tell user errors from
+// server faults.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf creates an error of kind with formatted message.
+func Errorf(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrapf formats a message followed by the error, and keeps its kind.
+func Wrapf(err error, format string, args ...interface{}) error {
+	return &Error{Kind: KindOf(err), Message: fmt.Sprintf(format, args...) + ": " + err.Error()}
+}
+
+// KindOf returns the kind of error, KindInternal if not specified.
+func KindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	} else if err == context.DeadlineExceeded {
+		return KindTimeout
+	}
+	return KindInternal
+}
@@ -0,0 +1,26 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKind(t *testing.T) {
+	err := Errorf(KindInvalid, "invalid key %s", "a.b")
+	assert.Equal(t, "invalid key a.b", err.Error())
+	assert.Equal(t, KindInvalid, KindOf(err))
+
+	// the kind is kept by wrapping.
+	wrapped := Wrapf(err, "failed to set %s", "/path")
+	assert.Equal(t, "failed to set /path: invalid key a.b", wrapped.Error())
+	assert.Equal(t, KindInvalid, KindOf(wrapped))
+
+	assert.Equal(t, KindTimeout, KindOf(context.DeadlineExceeded))
+	assert.Equal(t, KindTimeout, KindOf(Wrapf(context.DeadlineExceeded, "failed to set %s", "/path")))
+	assert.Equal(t, KindInternal, KindOf(errors.New("unknown")))
+	assert.Equal(t, KindInternal, KindOf(fmt.Errorf("failed: %v", err)))
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Hash returns the Firebase node hash of data, which is used by clients to compare
+// data in transactions, empty for nil data.
+func Hash(v interface{}) string {
+	text := hashText(v)
+	if text == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(text))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hashText returns the text to be hashed for a node, which starts with the priority
+// if given.
+func hashText(v interface{}) string {
+	prefix := ""
+	if priority := Priority(v); priority != nil {
+		prefix = "priority:" + hashText(priority) + ":"
+	}
+
+	switch v := Value(v).(type) {
+	case nil:
+		return ""
+	case map[string]interface{}:
+		// concat the hashes of children in priority order.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			if k != PriorityKey {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return Query{}.Less(keys[i], Priority(v[keys[i]]), keys[j], Priority(v[keys[j]]))
+		})
+		text := ""
+		for _, k := range keys {
+			if h := Hash(v[k]); h != "" {
+				text += ":" + k + ":" + h
+			}
+		}
+		if text == "" {
+			return ""
+		}
+		return prefix + text
+	case bool:
+		return prefix + fmt.Sprintf("boolean:%t", v)
+	case string:
+		return prefix + "string:" + v
+	}
+
+	// numbers are hashed by the IEEE 754 representation.
+	if f, ok := toFloat(v); ok {
+		return prefix + fmt.Sprintf("number:%016x", math.Float64bits(f))
+	}
+	return prefix + "string:" + fmt.Sprint(v)
+}
+
+// toFloat converts a number of any type into float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,39 @@
+package data
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash(t *testing.T) {
+	testCases := []struct {
+		v    interface{}
+		hash string
+	}{
+		{nil, ""},
+		{map[string]interface{}{}, ""},
+		{"a", "eMfSk0nU+CieTkCbO5r7cKNp7qU="},
+		{float64(1), "YPVfR2bXt/lcDjiQZ8pOkAd3qkQ="},
+		{int64(1), "YPVfR2bXt/lcDjiQZ8pOkAd3qkQ="},
+		{true, "E5z61QM0lN/U2WsOnusszCTkR8M="},
+		{map[string]interface{}{"a": float64(1), "10": true, "2": "a", "empty": nil}, "zviS+xyCmiZIR0EKMjciLSj4lzE="},
+		{map[string]interface{}{".value": "a", ".priority": float64(1)}, "Mh5R9Rxk6SEP+0a5KglrpE+fD44="},
+		// the children are hashed in priority order.
+		{map[string]interface{}{"a": map[string]interface{}{".value": true, ".priority": "x"}, "b": float64(2)}, "3UgHaQb8m2jwez5WfSIlhSoitN8="},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.hash, Hash(tc.v), "%v", tc.v)
+	}
+}
+
+func TestCompareKeys(t *testing.T) {
+	keys := []string{"b", "a", "10", "2", "-1", "010", "2147483648", "A"}
+	sort.Slice(keys, func(i, j int) bool {
+		return CompareKeys(keys[i], keys[j]) < 0
+	})
+	assert.Equal(t, []string{"-1", "2", "10", "010", "2147483648", "A", "a", "b"}, keys)
+	assert.Equal(t, 0, CompareKeys("a", "a"))
+}
@@ -23,7 +23,7 @@ func (i InitMessage) Format() O {
 		"d": O{
 			"t": "h",
 			"d": O{
-				"ts": i.Now.Unix() * 1000,
+				"ts": i.Timestamp(),
 				"v":  "5",
 				"h":  i.Host,
 				"s":  "",
@@ -33,6 +33,11 @@ func (i InitMessage) Format() O {
 	}
 }
 
+// Timestamp returns the server timestamp in milliseconds sent in handshake.
+func (i InitMessage) Timestamp() int64 {
+	return i.Now.UnixNano() / int64(time.Millisecond)
+}
+
 // IdleMessage defines the response message when idle event received.
 type IdleMessage struct{}
 
@@ -47,6 +52,23 @@ func (i IdleMessage) Format() O {
 	}
 }
 
+// RedirectMessage defines the control message to make client reconnect to another host,
+// which is known as reset in Firebase clients.
+type RedirectMessage struct {
+	Host string
+}
+
+// Format formats a message into response.
+func (m RedirectMessage) Format() O {
+	return O{
+		"d": O{
+			"t": "r",
+			"d": m.Host,
+		},
+		"t": "c",
+	}
+}
+
 // OkMessage defines the response message when request is handled.
 type OkMessage struct {
 	RequestID int64
@@ -71,18 +93,91 @@ func (m OkMessage) Format() O {
 	}
 }
 
+// StaleMessage defines the response message when a transaction is rejected since the
+// hash of current data does not match.
+type StaleMessage struct {
+	RequestID int64
+}
+
+// Format formats a message into response.
+func (m StaleMessage) Format() O {
+	return O{
+		"d": O{
+			"r": m.RequestID,
+			"b": O{
+				"s": "datastale",
+				"d": "Transaction hash does not match",
+			},
+		},
+		"t": "d",
+	}
+}
+
+// GetMessage defines the response message when get request is handled.
+type GetMessage struct {
+	RequestID int64
+	Data      interface{}
+}
+
+// Format formats a message into response.
+func (m GetMessage) Format() O {
+	return O{
+		"d": O{
+			"r": m.RequestID,
+			"b": O{
+				"s": "ok",
+				"d": m.Data,
+			},
+		},
+		"t": "d",
+	}
+}
+
+// FailedMessage defines the response message when a request fails.
+type FailedMessage struct {
+	RequestID int64
+	// Status defines the status reported to client, "failed" if empty.
+	Status string
+	Reason string
+}
+
+// Format formats a message into response.
+func (m FailedMessage) Format() O {
+	status := m.Status
+	if status == "" {
+		status = "failed"
+	}
+	return O{
+		"d": O{
+			"r": m.RequestID,
+			"b": O{
+				"s": status,
+				"d": m.Reason,
+			},
+		},
+		"t": "d",
+	}
+}
+
 // ListenMessage defines the response message when listen event received.
 type ListenMessage struct {
 	Ref     string
 	QueryID int64
 	Data    interface{}
+	// Merge indicates the Data is a map of changed children to merge, where nil
+	// removes the child, otherwise the Data replaces the whole reference.
+	Merge bool
 }
 
 // Format formats a message into response.
 func (m ListenMessage) Format() O {
+	action := "d"
+	if m.Merge {
+		action = "m"
+	}
 	return O{
 		"d": O{
-			"a": "d",
+			"a": action,
 			"b": O{
 				"p": m.Ref,
 				"d": m.Data,
@@ -92,3 +187,20 @@ func (m ListenMessage) Format() O {
 		"t": "d",
 	}
 }
+
+// ErrorMessage defines the control message to report a server error before the
+// connection is closed.
+type ErrorMessage struct {
+	Reason string
+}
+
+// Format formats a message into response.
+func (m ErrorMessage) Format() O {
+	return O{
+		"d": O{
+			"t": "e",
+			"d": m.Reason,
+		},
+		"t": "c",
+	}
+}
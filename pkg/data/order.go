@@ -0,0 +1,246 @@
+package data
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Index returns the value of a child to be ordered by the query, which is the
+// priority by default.
+func (q Query) Index(key string, value interface{}) interface{} {
+	switch q.OrderBy {
+	case ".key", "$key":
+		return key
+	case ".value", "$value":
+		return Value(value)
+	case "", ".priority", "$priority":
+		return Priority(value)
+	}
+
+	// support nested query, the path is divided by "/" or ".".
+	index := value
+	for _, child := range strings.FieldsFunc(q.OrderBy, func(r rune) bool { return r == '/' || r == '.' }) {
+		m, ok := index.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		index = m[child]
+	}
+	return Value(index)
+}
+
+// The names sent by clients as the min and max keys to break the ties of bounds.
+const (
+	minKeyName = "[MIN_NAME]"
+	maxKeyName = "[MAX_NAME]"
+)
+
+// orderedByKey returns true if the children are ordered by key.
+func (q Query) orderedByKey() bool {
+	return q.OrderBy == ".key" || q.OrderBy == "$key"
+}
+
+// Within returns true if a child is in the range of query.
+func (q Query) Within(key string, index interface{}) bool {
+	// filter by startAt and endAt, which are keys if ordered by key, otherwise the ties
+	// are broken by startKey and endKey.
+	compare := func(bound interface{}, boundKey string) int {
+		if q.orderedByKey() {
+			return CompareKeys(key, fmt.Sprint(bound))
+		}
+		c := Compare(index, bound)
+		switch {
+		case c != 0 || boundKey == "":
+			return c
+		case boundKey == minKeyName:
+			return 1
+		case boundKey == maxKeyName:
+			return -1
+		}
+		return CompareKeys(key, boundKey)
+	}
+	if q.StartAt != nil {
+		if c := compare(q.StartAt, q.StartKey); c < 0 || (c == 0 && q.StartAfter) {
+			return false
+		}
+	}
+	if q.EndAt != nil {
+		if c := compare(q.EndAt, q.EndKey); c > 0 || (c == 0 && q.EndBefore) {
+			return false
+		}
+	}
+
+	// filter by startKey and endKey if no startAt or endAt.
+	if q.StartAt == nil && q.StartKey != "" {
+		if c := CompareKeys(key, q.StartKey); c < 0 || (c == 0 && q.StartAfter) {
+			return false
+		}
+	}
+	if q.EndAt == nil && q.EndKey != "" {
+		if c := CompareKeys(key, q.EndKey); c > 0 || (c == 0 && q.EndBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// Less returns true if a child is ordered before another one.
+func (q Query) Less(key1 string, index1 interface{}, key2 string, index2 interface{}) bool {
+	if !q.orderedByKey() {
+		if c := Compare(index1, index2); c != 0 {
+			return c < 0
+		}
+	}
+
+	// if index equals, compare key.
+	return CompareKeys(key1, key2) < 0
+}
+
+// Select returns the keys of children in the range and limit of query.
+func (q Query) Select(children map[string]interface{}) []string {
+	type child struct {
+		key   string
+		index interface{}
+	}
+	selected := make([]child, 0, len(children))
+
+	// for each child, find the index for ordering and filter by range.
+	for k, v := range children {
+		index := q.Index(k, v)
+		if q.Within(k, index) {
+			selected = append(selected, child{key: k, index: index})
+		}
+	}
+
+	// sort the children and filter by limit.
+	if limit := q.Limit; limit != 0 {
+		sort.Slice(selected, func(i, j int) bool {
+			return q.Less(selected[i].key, selected[i].index, selected[j].key, selected[j].index)
+		})
+		if limit > len(selected) {
+			limit = len(selected)
+		}
+		if q.LimitOrder == "l" {
+			// limitToFirst case.
+			selected = selected[:limit]
+		} else {
+			// limitToLast case.
+			selected = selected[len(selected)-limit:]
+		}
+	}
+
+	keys := make([]string, len(selected))
+	for i, c := range selected {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// Value types in Firebase order.
+const (
+	rankNull = iota
+	rankFalse
+	rankTrue
+	rankNumber
+	rankString
+	rankObject
+)
+
+// rank returns the order of value type.
+func rank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return rankNull
+	case bool:
+		if v {
+			return rankTrue
+		}
+		return rankFalse
+	case string:
+		return rankString
+	}
+	if _, ok := toFloat(v); ok {
+		return rankNumber
+	}
+	return rankObject
+}
+
+// IsBound checks if the value can bound a query, which is null, boolean, number or
+// string, the objects are not comparable.
+func IsBound(v interface{}) bool {
+	return rank(v) != rankObject
+}
+
+// Compare compares two values in Firebase order, which is null, false, true, numbers
+// ascending, strings lexicographically and then objects. The objects are equal, so the
+// ties are broken by keys.
+func Compare(a, b interface{}) int {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch ra {
+	case rankNumber:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	}
+	return 0
+}
+
+// Windowed returns true if the query selects a range or a limited number of children.
+func (q Query) Windowed() bool {
+	return q.Limit != 0 || q.StartAt != nil || q.EndAt != nil || q.StartKey != "" || q.EndKey != ""
+}
+
+// CompareKeys compares two keys in Firebase order, where the keys of 32-bit integer
+// are ordered numerically before the other keys.
+func CompareKeys(a, b string) int {
+	if a == b {
+		return 0
+	}
+	i, aIsInt := keyToInt(a)
+	j, bIsInt := keyToInt(b)
+	switch {
+	case aIsInt && bIsInt:
+		if i == j {
+			// the same integer with leading zeros.
+			return len(a) - len(b)
+		}
+		if i < j {
+			return -1
+		}
+		return 1
+	case aIsInt:
+		return -1
+	case bIsInt:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 1
+}
+
+// keyToInt parses a key as 32-bit integer.
+func keyToInt(key string) (int64, bool) {
+	digits := strings.TrimPrefix(key, "-")
+	if digits == "" || len(strings.TrimLeft(digits, "0")) > 10 || strings.IndexFunc(digits, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) >= 0 {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(key, 10, 64)
+	if err != nil || i < math.MinInt32 || i > math.MaxInt32 {
+		return 0, false
+	}
+	return i, true
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	// values in Firebase order.
+	ordered := []interface{}{nil, false, true, -1, float64(2), int64(9), float64(10), "10", "9", "a", map[string]interface{}{"a": 1}}
+	for i := range ordered {
+		for j := range ordered {
+			c := Compare(ordered[i], ordered[j])
+			switch {
+			case i < j:
+				assert.True(t, c < 0, "%v < %v", ordered[i], ordered[j])
+			case i > j:
+				assert.True(t, c > 0, "%v > %v", ordered[i], ordered[j])
+			default:
+				assert.Zero(t, c)
+			}
+		}
+	}
+	assert.Zero(t, Compare(map[string]interface{}{"a": 1}, map[string]interface{}{"b": 2}))
+}
+
+func TestSelect(t *testing.T) {
+	children := map[string]interface{}{
+		"a": map[string]interface{}{"score": float64(10)},
+		"b": map[string]interface{}{"score": float64(9)},
+		"c": map[string]interface{}{"score": "9"},
+		"d": map[string]interface{}{"score": true},
+		"e": map[string]interface{}{},
+		"f": map[string]interface{}{"score": float64(9)},
+	}
+	testCases := []struct {
+		query Query
+		keys  []string
+	}{
+		{Query{OrderBy: "score", Limit: 6, LimitOrder: "l"}, []string{"e", "d", "b", "f", "a", "c"}},
+		{Query{OrderBy: "score", Limit: 2, LimitOrder: "r"}, []string{"a", "c"}},
+		{Query{OrderBy: "score", StartAt: float64(9), EndAt: float64(10), Limit: 6, LimitOrder: "l"}, []string{"b", "f", "a"}},
+		{Query{OrderBy: "$key", StartAt: "b", EndAt: "d", Limit: 6, LimitOrder: "l"}, []string{"b", "c", "d"}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.keys, tc.query.Select(children), "%+v", tc.query)
+	}
+
+	// children are ordered by priority by default, then by key.
+	prioritized := map[string]interface{}{
+		"a": map[string]interface{}{".value": "x", ".priority": "p"},
+		"b": map[string]interface{}{".value": "x", ".priority": float64(2)},
+		"c": map[string]interface{}{"key": "value", ".priority": float64(1)},
+		"d": "x",
+	}
+	assert.Equal(t, []string{"d", "c", "b", "a"}, Query{Limit: 4, LimitOrder: "l"}.Select(prioritized))
+	assert.Equal(t, []string{"c", "b"}, Query{OrderBy: "$priority", StartAt: float64(1), EndAt: float64(2), Limit: 4, LimitOrder: "l"}.Select(prioritized))
+	assert.Equal(t, []string{"a", "b", "d", "c"}, Query{OrderBy: "$value", StartAt: "x", Limit: 4, LimitOrder: "l"}.Select(prioritized))
+
+	// integer keys are ordered numerically.
+	keys := Query{OrderBy: "$key", Limit: 4, LimitOrder: "l"}.Select(map[string]interface{}{"10": 1, "9": 1, "a": 1, "-1": 1})
+	assert.Equal(t, []string{"-1", "9", "10", "a"}, keys)
+}
+
+func TestWithin(t *testing.T) {
+	children := map[string]interface{}{
+		"a": float64(1),
+		"b": float64(2),
+		"c": float64(2),
+		"d": float64(2),
+		"e": float64(3),
+	}
+	testCases := []struct {
+		query Query
+		keys  []string
+	}{
+		{Query{OrderBy: "$value", StartAt: float64(2), StartAfter: true}, []string{"e"}},
+		{Query{OrderBy: "$value", EndAt: float64(2), EndBefore: true}, []string{"a"}},
+		{Query{OrderBy: "$value", StartAt: float64(2), StartKey: "c"}, []string{"c", "d", "e"}},
+		{Query{OrderBy: "$value", StartAt: float64(2), StartKey: "c", StartAfter: true}, []string{"d", "e"}},
+		{Query{OrderBy: "$value", EndAt: float64(2), EndKey: "c", EndBefore: true}, []string{"a", "b"}},
+		{Query{OrderBy: "$value", StartAt: float64(2), StartKey: "[MAX_NAME]"}, []string{"e"}},
+		{Query{OrderBy: "$value", EndAt: float64(2), EndKey: "[MIN_NAME]"}, []string{"a"}},
+		{Query{OrderBy: "$key", StartAt: "b", StartAfter: true, EndAt: "d", EndBefore: true}, []string{"c"}},
+		{Query{StartKey: "b", EndKey: "d", EndBefore: true}, []string{"b", "c"}},
+	}
+	for _, tc := range testCases {
+		tc.query.Limit, tc.query.LimitOrder = len(children), "l"
+		assert.Equal(t, tc.keys, tc.query.Select(children), "%+v", tc.query)
+	}
+}
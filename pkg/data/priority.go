@@ -0,0 +1,98 @@
+package data
+
+// The keys of the priority of a node and the value of a leaf with priority, which is
+// the export format to store and send data.
+const (
+	PriorityKey = ".priority"
+	ValueKey    = ".value"
+)
+
+// Priority returns the priority of a node, nil if not given.
+func Priority(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m[PriorityKey]
+	}
+	return nil
+}
+
+// Value returns the value of a leaf regardless of its priority, a node with children
+// is returned as is.
+func Value(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		if value, ok := m[ValueKey]; ok {
+			return value
+		}
+	}
+	return v
+}
+
+// WithPriority returns the data with priority, the priority is removed if nil.
+func WithPriority(v interface{}, priority interface{}) interface{} {
+	value := Value(v)
+	m, ok := value.(map[string]interface{})
+	if value == nil {
+		// null has no priority.
+		return nil
+	} else if !ok {
+		if priority == nil {
+			return value
+		}
+		return map[string]interface{}{ValueKey: value, PriorityKey: priority}
+	}
+
+	node := make(map[string]interface{}, len(m)+1)
+	for k, child := range m {
+		node[k] = child
+	}
+	if priority == nil {
+		delete(node, PriorityKey)
+	} else {
+		node[PriorityKey] = priority
+	}
+	return node
+}
+
+// StripPriority returns the data without priorities, which is copied only if any
+// priority is found.
+func StripPriority(v interface{}) interface{} {
+	stripped, _ := stripPriority(v)
+	return stripped
+}
+
+// stripPriority returns the data without priorities and whether it's changed.
+func stripPriority(v interface{}) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v, false
+	}
+	if value, ok := m[ValueKey]; ok {
+		return value, true
+	}
+
+	// copy the node on the first change.
+	var stripped map[string]interface{}
+	for k, child := range m {
+		s, changed := stripPriority(child)
+		if k != PriorityKey && !changed {
+			continue
+		}
+		if stripped == nil {
+			stripped = make(map[string]interface{}, len(m))
+			for k, child := range m {
+				stripped[k] = child
+			}
+		}
+		if k == PriorityKey || s == nil {
+			delete(stripped, k)
+		} else {
+			stripped[k] = s
+		}
+	}
+	if stripped == nil {
+		return v, false
+	} else if len(stripped) == 0 {
+		// a node with only priority is null.
+		return nil, true
+	}
+	return stripped, true
+}
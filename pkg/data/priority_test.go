@@ -0,0 +1,38 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripPriority(t *testing.T) {
+	v := map[string]interface{}{
+		".priority": float64(1),
+		"leaf":      map[string]interface{}{".value": "value", ".priority": "a"},
+		"child":     map[string]interface{}{"key": "value"},
+		"empty":     map[string]interface{}{".priority": "b"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"leaf":  "value",
+		"child": map[string]interface{}{"key": "value"},
+	}, StripPriority(v))
+
+	// the data is not copied without priority.
+	child := v["child"].(map[string]interface{})
+	child["other"] = true
+	assert.Equal(t, child, StripPriority(child))
+	assert.Equal(t, "value", StripPriority("value"))
+	assert.Nil(t, StripPriority(nil))
+}
+
+func TestWithPriority(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{".value": "value", ".priority": float64(1)}, WithPriority("value", float64(1)))
+	assert.Equal(t, "value", WithPriority(map[string]interface{}{".value": "value", ".priority": float64(1)}, nil))
+	assert.Equal(t, map[string]interface{}{"key": "value", ".priority": "a"}, WithPriority(map[string]interface{}{"key": "value"}, "a"))
+	assert.Equal(t, map[string]interface{}{"key": "value"}, WithPriority(map[string]interface{}{"key": "value", ".priority": "a"}, nil))
+	assert.Nil(t, WithPriority(nil, float64(1)))
+
+	assert.Equal(t, float64(1), Priority(WithPriority("value", float64(1))))
+	assert.Equal(t, "value", Value(WithPriority("value", float64(1))))
+}
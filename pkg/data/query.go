@@ -16,6 +16,10 @@ const (
 	TypeUpdate
 	TypeRemove
 	TypeIdle
+	TypeDisconnectSet
+	TypeDisconnectUpdate
+	TypeDisconnectCancel
+	TypeStats
 )
 
 // Request defines the database request from client.
@@ -28,10 +32,15 @@ type Request struct {
 	// RequestID defines the id of client request.
 	RequestID int64
 
-	// Data defines the update payload if type is Set or Update.
+	// Data defines the update payload if type is Set, Update or their onDisconnect variants.
 	Data interface{}
-	// Query defines the query for Listen or Unlisten.
+	// Query defines the query for Listen, Unlisten or Get.
 	Query Query
+	// Stats defines the client counters if type is Stats.
+	Stats map[string]interface{}
+	// Hash defines the expected hash of current data if type is Set, the request is
+	// applied only if matched, which is used by transactions. It's nil if not given.
+	Hash *string
 }
 
 // Query defines the filter and order when retrieving data.
@@ -40,12 +49,18 @@ type Query struct {
 	ID int64
 	// StartAt defines the value of start, should be with OrderBy.
 	StartAt interface{}
-	// StartKey defines the key of start.
+	// StartKey defines the key of start, which breaks the ties of StartAt if given,
+	// otherwise it filters the keys regardless of order.
 	StartKey string
+	// StartAfter defines the start is exclusive.
+	StartAfter bool
 	// EndAt defines the value of end, should be with OrderBy.
 	EndAt interface{}
-	// EndKey defines the key of end.
+	// EndKey defines the key of end, which breaks the ties of EndAt if given,
+	// otherwise it filters the keys regardless of order.
 	EndKey string
+	// EndBefore defines the end is exclusive.
+	EndBefore bool
 	// OrderBy defines the field to be ordered, can be ".key", ".value" or child field name.
 	OrderBy string
 	// Limit defines the query limit.
@@ -74,16 +89,24 @@ type r struct {
 			D interface{} `json:"d"`
 			// T indicates the query ID.
 			T int64 `json:"t"`
+			// C indicates the client counters for stats.
+			C map[string]interface{} `json:"c"`
+			// H indicates the hash of current data for transactions.
+			H *string `json:"h"`
 			// Q indicates the query to retrieve data.
 			Q *struct {
 				// SP indicates "start at" query.
 				SP interface{} `json:"sp"`
 				// SN indicates "start key" query
 				SN string `json:"sn"`
+				// SIN indicates whether the start is inclusive, true if not given.
+				SIN *bool `json:"sin"`
 				// EP indicates "end at" query.
 				EP interface{} `json:"ep"`
 				// EN indicates "end key" query.
 				EN string `json:"en"`
+				// EIN indicates whether the end is inclusive, true if not given.
+				EIN *bool `json:"ein"`
 				// I indicates "order by" query
 				I string `json:"i"`
 				// L indicates "limit".
@@ -124,10 +147,20 @@ func (req *Request) UnmarshalJSON(bytes []byte) error {
 		req.Type = TypeListen
 	case "n":
 		req.Type = TypeUnlisten
+	case "g":
+		req.Type = TypeGet
 	case "m":
 		req.Type = TypeUpdate
 	case "p":
 		req.Type = TypeSet
+	case "o":
+		req.Type = TypeDisconnectSet
+	case "om":
+		req.Type = TypeDisconnectUpdate
+	case "oc":
+		req.Type = TypeDisconnectCancel
+	case "s":
+		req.Type = TypeStats
 	default:
 		return fmt.Errorf("unknown r.D.A: %s", r.D.A)
 	}
@@ -141,13 +174,22 @@ func (req *Request) UnmarshalJSON(bytes []byte) error {
 	req.Ref = r.D.B.P
 	req.Data = r.D.B.D
 	req.Query.ID = r.D.B.T
+	req.Stats = r.D.B.C
+	req.Hash = r.D.B.H
 
 	// convert query parameters.
 	if r.D.B.Q != nil {
+		if !IsBound(r.D.B.Q.SP) {
+			return fmt.Errorf("invalid r.D.B.Q.SP: %v", r.D.B.Q.SP)
+		} else if !IsBound(r.D.B.Q.EP) {
+			return fmt.Errorf("invalid r.D.B.Q.EP: %v", r.D.B.Q.EP)
+		}
 		req.Query.StartAt = r.D.B.Q.SP
 		req.Query.StartKey = r.D.B.Q.SN
 		req.Query.EndAt = r.D.B.Q.EP
 		req.Query.EndKey = r.D.B.Q.EN
+		req.Query.StartAfter = r.D.B.Q.SIN != nil && !*r.D.B.Q.SIN
+		req.Query.EndBefore = r.D.B.Q.EIN != nil && !*r.D.B.Q.EIN
 		req.Query.OrderBy = r.D.B.Q.I
 		req.Query.Limit = r.D.B.Q.L
 		req.Query.LimitOrder = r.D.B.Q.VF
@@ -15,7 +15,7 @@ func TestUnmarshalListenQuery(t *testing.T) {
 		Type:      TypeListen,
 		Ref:       "/path",
 		RequestID: 10,
-		Query: &Query{
+		Query: Query{
 			ID:         3,
 			StartAt:    float64(5),
 			StartKey:   "startKey",
@@ -28,6 +28,20 @@ func TestUnmarshalListenQuery(t *testing.T) {
 	}, r)
 }
 
+func TestUnmarshalExclusiveQuery(t *testing.T) {
+	b := []byte(`{"t":"d","d":{"r":10,"a":"q","b":{"p":"/path","t":3,"q":{"sp":5,"sn":"startKey","sin":false,"ep":8,"ein":true,"i":"child"}}}}`)
+	var r *Request
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.EqualValues(t, Query{
+		ID:         3,
+		StartAt:    float64(5),
+		StartKey:   "startKey",
+		StartAfter: true,
+		EndAt:      float64(8),
+		OrderBy:    "child",
+	}, r.Query)
+}
+
 func TestUnmarshalUnlistenQuery(t *testing.T) {
 	b := []byte(`{"t":"d","d":{"r":10,"a":"n","b":{"p":"/path","t":3,"q":{"sp":5,"sn":"startKey","ep":8,"en":"endKey","i":"child","l":3,"vf":"l"}}}}`)
 	var r *Request
@@ -36,7 +50,7 @@ func TestUnmarshalUnlistenQuery(t *testing.T) {
 		Type:      TypeUnlisten,
 		Ref:       "/path",
 		RequestID: 10,
-		Query: &Query{
+		Query: Query{
 			ID:         3,
 			StartAt:    float64(5),
 			StartKey:   "startKey",
@@ -78,3 +92,69 @@ func TestUnmarshalSetQuery(t *testing.T) {
 		},
 	}, r)
 }
+
+func TestUnmarshalGetQuery(t *testing.T) {
+	b := []byte(`{"t":"d","d":{"r":10,"a":"g","b":{"p":"/path","q":{"sp":5,"i":"child","l":3,"vf":"l"}}}}`)
+	var r *Request
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.EqualValues(t, &Request{
+		Type:      TypeGet,
+		Ref:       "/path",
+		RequestID: 10,
+		Query: Query{
+			StartAt:    float64(5),
+			OrderBy:    "child",
+			Limit:      3,
+			LimitOrder: "l",
+		},
+	}, r)
+}
+
+func TestUnmarshalInvalidBound(t *testing.T) {
+	// the objects can't bound a query.
+	for _, b := range []string{
+		`{"t":"d","d":{"r":10,"a":"g","b":{"p":"/path","q":{"sp":{"a":1},"ep":{"a":1},"i":".key"}}}}`,
+		`{"t":"d","d":{"r":10,"a":"q","b":{"p":"/path","t":3,"q":{"ep":[1],"i":"child"}}}}`,
+	} {
+		var r *Request
+		assert.Error(t, json.Unmarshal([]byte(b), &r), b)
+	}
+}
+
+func TestUnmarshalDisconnectQuery(t *testing.T) {
+	testCases := []struct {
+		action string
+		t      int
+	}{
+		{"o", TypeDisconnectSet},
+		{"om", TypeDisconnectUpdate},
+		{"oc", TypeDisconnectCancel},
+	}
+
+	for _, tc := range testCases {
+		b := []byte(`{"t":"d","d":{"r":10,"a":"` + tc.action + `","b":{"p":"/path","d":{"key1":"value1"}}}}`)
+		var r *Request
+		assert.NoError(t, json.Unmarshal(b, &r))
+		assert.EqualValues(t, &Request{
+			Type:      tc.t,
+			Ref:       "/path",
+			RequestID: 10,
+			Data: map[string]interface{}{
+				"key1": "value1",
+			},
+		}, r)
+	}
+}
+
+func TestUnmarshalStatsQuery(t *testing.T) {
+	b := []byte(`{"t":"d","d":{"r":1,"a":"s","b":{"c":{"sdk.js.9-23-0":1}}}}`)
+	var r *Request
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.EqualValues(t, &Request{
+		Type:      TypeStats,
+		RequestID: 1,
+		Stats: map[string]interface{}{
+			"sdk.js.9-23-0": float64(1),
+		},
+	}, r)
+}
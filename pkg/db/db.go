@@ -21,6 +21,12 @@ type Client interface {
 	io.Closer
 	// Set inserts or updates the data to given reference.
 	Set(ctx context.Context, ref string, data interface{}) error
+	// SetIf sets the data only if the condition holds for the current data, which are
+	// compared and set atomically. It returns the current data and whether it's set.
+	SetIf(ctx context.Context, ref string, data interface{}, cond func(current interface{}) bool) (interface{}, bool, error)
+	// SetPriority sets the priority of the node at reference atomically, the priority is
+	// removed if nil.
+	SetPriority(ctx context.Context, ref string, priority interface{}) error
 	// Get retrieves the data from reference by given query.
 	Get(ctx context.Context, ref string, query data.Query) (interface{}, error)
 	// Reset cleans all data stored, for testing purpose.
@@ -2,8 +2,6 @@ package memory
 
 import (
 	"context"
-	"fmt"
-	"sort"
 	"strings"
 
 	"github.com/IguteChung/flakbase/pkg/data"
@@ -23,6 +21,44 @@ func (c *client) Set(ctx context.Context, ref string, data interface{}) error {
 	c.Lock()
 	defer c.Unlock()
 
+	// give up if the request is cancelled while waiting for lock.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.set(ref, data)
+	return nil
+}
+
+func (c *client) SetIf(ctx context.Context, ref string, value interface{}, cond func(current interface{}) bool) (interface{}, bool, error) {
+	// lock the whole db to compare and set.
+	c.Lock()
+	defer c.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	current := c.get(ref, data.Query{})
+	if !cond(current) {
+		return current, false, nil
+	}
+	c.set(ref, value)
+	return current, true, nil
+}
+
+func (c *client) SetPriority(ctx context.Context, ref string, priority interface{}) error {
+	// lock the whole db to read and set the node.
+	c.Lock()
+	defer c.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.set(ref, data.WithPriority(c.get(ref, data.Query{}), priority))
+	return nil
+}
+
+// set sets the data to reference, should be called with lock.
+func (c *client) set(ref string, value interface{}) {
 	// for each segment of path, append the data to the data tree.
 	m := c.m
 	paths := strings.Split(ref, "/")
@@ -34,25 +70,25 @@ func (c *client) Set(ctx context.Context, ref string, data interface{}) error {
 
 		// trailing branch.
 		if i == len(paths)-1 {
-			if data == nil {
+			if value == nil {
 				// for delete case.
 				delete(m, p)
 			} else {
-				m[p] = deepcopy.Copy(data)
+				m[p] = deepcopy.Copy(value)
 			}
 			break
 		}
 
-		// handle if branch not exists.
-		if _, ok := m[p].(map[string]interface{}); !ok {
+		// handle if branch not exists, a leaf with priority becomes a node.
+		if child, ok := m[p].(map[string]interface{}); !ok {
 			m[p] = map[string]interface{}{}
+		} else {
+			delete(child, data.ValueKey)
 		}
 
 		// move the pointer to child.
 		m = m[p].(map[string]interface{})
 	}
-
-	return nil
 }
 
 func (c *client) Get(ctx context.Context, ref string, query data.Query) (interface{}, error) {
@@ -60,9 +96,17 @@ func (c *client) Get(ctx context.Context, ref string, query data.Query) (interfa
 	c.RLock()
 	defer c.RUnlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.get(ref, query), nil
+}
+
+// get gets the data from reference by query, should be called with lock.
+func (c *client) get(ref string, query data.Query) interface{} {
 	// handle query on root.
 	if ref == "/" {
-		return queryOnData(c.m, query), nil
+		return queryOnData(c.m, query)
 	}
 
 	m := c.m
@@ -75,18 +119,18 @@ func (c *client) Get(ctx context.Context, ref string, query data.Query) (interfa
 
 		// trailing branch.
 		if i == len(paths)-1 {
-			return queryOnData(m[p], query), nil
+			return queryOnData(m[p], query)
 		}
 
 		// move the pointer to child.
 		if child, ok := m[p].(map[string]interface{}); ok {
 			m = child
 		} else {
-			return nil, nil
+			return nil
 		}
 	}
 
-	return nil, nil
+	return nil
 }
 
 func queryOnData(data interface{}, query data.Query) interface{} {
@@ -96,95 +140,14 @@ func queryOnData(data interface{}, query data.Query) interface{} {
 		return data
 	}
 
-	type node struct {
-		key   string
-		value interface{}
-		index interface{}
-	}
-	updated := make([]*node, 0, len(m))
-
-	// for each node in map, find the key index for ordering.
-	for k, v := range m {
-		var index interface{}
-		switch query.OrderBy {
-		case ".key", "$key":
-			index = k
-		case ".value", "$value":
-			index = v
-		case "":
-			// do nothing
-		default:
-			// support nested query.
-			ptr := v
-			orderBys := strings.Split(query.OrderBy, ".")
-			for i, orderBy := range orderBys {
-				if orderBy == "" {
-					// leading space.
-					continue
-				}
-
-				if ptrMap, ok := ptr.(map[string]interface{}); ok {
-					if i == len(orderBys)-1 {
-						// pick the index from child.
-						index = ptrMap[orderBy]
-						break
-					}
-					// move ptr to child.
-					ptr = ptrMap[orderBy]
-				}
-			}
-		}
-
-		// filter by startAt and endAt.
-		// TODO: currently convert interface to string and do the comparison.
-		if query.StartAt != nil && fmt.Sprint(index) < fmt.Sprint(query.StartAt) {
-			continue
-		}
-		if query.EndAt != nil && fmt.Sprint(index) > fmt.Sprint(query.EndAt) {
-			continue
-		}
-
-		// filter by startKey and endKey.
-		if query.StartKey != "" && k < query.StartKey {
-			continue
-		}
-		if query.EndKey != "" && k > query.EndKey {
-			continue
-		}
-
-		updated = append(updated, &node{key: k, value: v, index: index})
-	}
-
-	// sort all nodes and filter by limit.
-	if limit := query.Limit; limit != 0 {
-		sort.Slice(updated, func(i int, j int) bool {
-			if updated[i].index == updated[j].index {
-				// if index equals, compare key.
-				return updated[i].key < updated[j].key
-			}
-			// TODO: currently convert interface to string and do the comparison.
-			return fmt.Sprint(updated[i].index) < fmt.Sprint(updated[j].index)
-		})
-		if limit > len(updated) {
-			limit = len(updated)
-		}
-		if query.LimitOrder == "l" {
-			// limitToFirst case.
-			updated = updated[:limit]
-		} else {
-			// limitToLast case.
-			updated = updated[len(updated)-limit:]
-		}
-	}
-
-	// generate response map.
+	// select the children by the range and limit of query.
 	updatedMap := map[string]interface{}{}
 	hasPrimary := false
-	for _, u := range updated {
-		if _, ok := u.value.(map[string]interface{}); !ok {
+	for _, k := range query.Select(m) {
+		if _, ok := m[k].(map[string]interface{}); !ok {
 			hasPrimary = true
 		}
-		updatedMap[u.key] = u.value
+		updatedMap[k] = m[k]
 	}
 
 	// handle shallow query is has no primary in map.
@@ -19,6 +19,15 @@ import (
 // errNotFound implies the error for document not found.
 var errNotFound = errors.New("not found")
 
+// errNoTransactions reports the transactions are not supported by a standalone mongodb.
+var errNoTransactions = data.Errorf(data.KindUnsupported, "transactions are not supported, mongodb must run as a replica set or sharded cluster")
+
+// maxPriorityRetries defines the max attempts to set a priority by single updates.
+const maxPriorityRetries = 3
+
+// codeNamespaceExists defines the mongodb error code for creating an existing collection.
+const codeNamespaceExists = 48
+
 // dataSnap defines the response for retrieving data.
 type dataSnap struct {
 	val     interface{}
@@ -47,6 +56,204 @@ func (c *client) CollectionTable() *mongo.Collection {
 }
 
 func (c *client) Set(ctx context.Context, ref string, data interface{}) error {
+	return c.set(ctx, ref, data)
+}
+
+// SetIf compares and sets the data in a transaction, so that a concurrent write to the
+// same documents aborts it, which requires mongodb running as a replica set.
+func (c *client) SetIf(ctx context.Context, ref string, value interface{}, cond func(current interface{}) bool) (interface{}, bool, error) {
+	var current interface{}
+	var ok bool
+	err := c.transact(ctx, ref, func(sc mongo.SessionContext) error {
+		var err error
+		current, ok, err = c.setIf(sc, ref, value, cond)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return current, ok, nil
+}
+
+// SetPriority sets the priority field of the node by a single update, a bare leaf is
+// replaced by a leaf with priority only if unchanged, and vice versa. The node which is
+// not a field of any document, or keeps changing, is set in transaction instead.
+func (c *client) SetPriority(ctx context.Context, ref string, priority interface{}) error {
+	coll, hash, id, field, err := c.locate(ctx, ref)
+	if err == errNotFound {
+		return c.setPriorityIn(ctx, ref, priority)
+	} else if err != nil {
+		return fmt.Errorf("failed to locate %s: %v", ref, err)
+	}
+	documents := c.Database().Collection(hash)
+
+	// the priority of a document or an object field is a field of it.
+	filter, prefix := bson.M{"_id": id}, ""
+	if field != "" {
+		filter[field] = bson.M{"$type": "object"}
+		prefix = field + "."
+	}
+	update := bson.M{"$set": bson.M{prefix + priorityField: priority}}
+	if priority == nil {
+		// a leaf with priority is converted back to a bare leaf below.
+		filter[prefix+valueField] = bson.M{"$exists": false}
+		update = bson.M{"$unset": bson.M{prefix + priorityField: ""}}
+	}
+
+	// retry a few times if the node is changing, then fall back to transaction.
+	for i := 0; i < maxPriorityRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if result, err := documents.UpdateOne(ctx, filter, update); err != nil {
+			return fmt.Errorf("failed to update document %s in collection %s: %v", id, coll, err)
+		} else if result.MatchedCount > 0 {
+			return nil
+		} else if field == "" {
+			return c.setPriorityIn(ctx, ref, priority)
+		}
+
+		// find the current field which is not an object node.
+		var document map[string]interface{}
+		if err := documents.FindOne(ctx, bson.M{"_id": id}).Decode(&document); err == mongo.ErrNoDocuments {
+			return c.setPriorityIn(ctx, ref, priority)
+		} else if err != nil {
+			return fmt.Errorf("failed to find document %s in collection %s: %v", id, coll, err)
+		}
+		var current interface{} = document
+		for _, p := range strings.Split(field, ".") {
+			m, _ := current.(map[string]interface{})
+			current = m[p]
+		}
+
+		// replace the leaf only if unchanged, otherwise retry.
+		m, isMap := current.(map[string]interface{})
+		var leafFilter bson.M
+		var leaf interface{}
+		switch {
+		case current == nil:
+			return c.setPriorityIn(ctx, ref, priority)
+		case isMap && m[valueField] == nil:
+			// changed to an object node.
+			continue
+		case priority == nil && !isMap:
+			// no priority to remove.
+			return nil
+		case priority == nil:
+			leafFilter = bson.M{"_id": id, prefix + valueField: m[valueField], prefix + priorityField: m[priorityField]}
+			leaf = m[valueField]
+		case isMap:
+			// changed to a leaf with priority.
+			continue
+		default:
+			leafFilter = bson.M{"_id": id, field: current}
+			leaf = bson.M{valueField: current, priorityField: priority}
+		}
+		if result, err := documents.UpdateOne(ctx, leafFilter, bson.M{"$set": bson.M{field: leaf}}); err != nil {
+			return fmt.Errorf("failed to update document %s in collection %s: %v", id, coll, err)
+		} else if result.MatchedCount > 0 {
+			return nil
+		}
+	}
+	return c.setPriorityIn(ctx, ref, priority)
+}
+
+// setPriorityIn sets the node with priority in transaction.
+func (c *client) setPriorityIn(ctx context.Context, ref string, priority interface{}) error {
+	return c.transact(ctx, ref, func(sc mongo.SessionContext) error {
+		current, err := c.Get(sc, ref, data.Query{})
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %v", ref, err)
+		}
+		return c.set(sc, ref, data.WithPriority(current, priority))
+	})
+}
+
+// transact runs the writes to reference in a transaction, which is retried if the
+// commit is interrupted. It returns errNoTransactions for a standalone mongodb.
+func (c *client) transact(ctx context.Context, ref string, fn func(sc mongo.SessionContext) error) error {
+	if ok, err := c.transactional(ctx); err != nil {
+		return fmt.Errorf("failed to check transaction support: %v", err)
+	} else if !ok {
+		return errNoTransactions
+	}
+
+	// collections can't be created in a transaction, prepare the ones possibly written.
+	if err := c.createCollections(ctx, ref); err != nil {
+		return fmt.Errorf("failed to create collections for %s: %v", ref, err)
+	}
+
+	return c.UseSession(ctx, func(sc mongo.SessionContext) error {
+		for {
+			if err := sc.StartTransaction(); err != nil {
+				return fmt.Errorf("failed to start transaction: %v", err)
+			}
+			if err := fn(sc); err != nil {
+				sc.AbortTransaction(sc)
+				return err
+			}
+
+			err := sc.CommitTransaction(sc)
+			if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.HasErrorLabel("TransientTransactionError") {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to commit transaction: %v", err)
+			}
+			return nil
+		}
+	})
+}
+
+// transactional checks if the mongodb supports transactions, which is a replica set
+// member or a mongos router.
+func (c *client) transactional(ctx context.Context) (bool, error) {
+	var result struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := c.Client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result); err != nil {
+		return false, fmt.Errorf("failed to run isMaster: %v", err)
+	}
+	return result.SetName != "" || result.Msg == "isdbgrid", nil
+}
+
+// setIf compares and sets the data, should be called in transaction.
+func (c *client) setIf(ctx context.Context, ref string, value interface{}, cond func(current interface{}) bool) (interface{}, bool, error) {
+	current, err := c.Get(ctx, ref, data.Query{})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get %s: %v", ref, err)
+	}
+	if !cond(current) {
+		return current, false, nil
+	}
+	if err := c.set(ctx, ref, value); err != nil {
+		return nil, false, fmt.Errorf("failed to set %s: %v", ref, err)
+	}
+	return current, true, nil
+}
+
+// createCollections creates the collection table and the collections which a write to
+// reference may insert a document into.
+func (c *client) createCollections(ctx context.Context, ref string) error {
+	names := []string{c.collTable}
+	for coll := path.Dir(ref); coll != "/" && len(names) < 3; coll = path.Dir(coll) {
+		names = append(names, hash(coll))
+	}
+	for _, name := range names {
+		err := c.Database().RunCommand(ctx, bson.D{{Key: "create", Value: name}}).Err()
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == codeNamespaceExists {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to create collection %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// set sets the data to reference.
+func (c *client) set(ctx context.Context, ref string, data interface{}) error {
+	data = encodePriority(data)
+
 	// try to update the document field.
 	if err := c.updateAncestor(ctx, ref, data); err == errNotFound {
 		// fallthrough.
@@ -132,9 +339,9 @@ func (c *client) Reset(ctx context.Context) error {
 	return c.Database().Drop(ctx)
 }
 
-// updateAncestor tries to update the field of existed document,
-// return errNotFound if no matched document.
-func (c *client) updateAncestor(ctx context.Context, ref string, data interface{}) error {
+// locate finds the ancestor collection of reference, and the document and the dotted
+// field of reference in it, return errNotFound if no ancestor collection.
+func (c *client) locate(ctx context.Context, ref string) (coll, hash, id, field string, err error) {
 	// generate possible ancestor collection paths.
 	subPath, subPaths := "/", []string{}
 	for _, p := range strings.Split(ref, "/") {
@@ -146,29 +353,48 @@ func (c *client) updateAncestor(ctx context.Context, ref string, data interface{
 	var collection bson.M
 	if err := c.Database().Collection(c.collTable).FindOne(ctx, bson.M{"_id": bson.M{"$in": subPaths}}).Decode(&collection); err == mongo.ErrNoDocuments {
 		// ancestor collection not found.
-		return errNotFound
+		return "", "", "", "", errNotFound
 	} else if err != nil {
-		return fmt.Errorf("failed to find ancestor collection %s: %v", ref, err)
+		return "", "", "", "", fmt.Errorf("failed to find ancestor collection %s: %v", ref, err)
 	}
 
 	// ancestor collection found.
-	coll, hash := collection["_id"].(string), collection["hash"].(string)
+	coll, hash = collection["_id"].(string), collection["hash"].(string)
 	rel, err := filepath.Rel(coll, ref)
 	if err != nil {
-		return fmt.Errorf("failed to find relative path of %s and %s", coll, ref)
+		return "", "", "", "", fmt.Errorf("failed to find relative path of %s and %s", coll, ref)
 	}
 	paths := strings.Split(rel, "/")
-	id := paths[0]
-	field := strings.Join(paths[1:], ".")
+	if paths[0] == "." {
+		// the reference is the collection.
+		return "", "", "", "", errNotFound
+	}
+	return coll, hash, paths[0], strings.Join(paths[1:], "."), nil
+}
+
+// updateAncestor tries to update the field of existed document,
+// return errNotFound if no matched document.
+func (c *client) updateAncestor(ctx context.Context, ref string, data interface{}) error {
+	coll, hash, id, field, err := c.locate(ctx, ref)
+	if err != nil {
+		return err
+	}
 	if field == "" {
 		// nothing to update, skip.
 		return errNotFound
 	}
 
-	// compose the update by relative path.
-	update := bson.M{"$set": bson.M{field: data}}
+	// compose the update by relative path, the ancestors which are leaves with priority
+	// become nodes by dropping their values.
+	unset := bson.M{valueField: ""}
+	paths := strings.Split(field, ".")
+	for i := 1; i < len(paths); i++ {
+		unset[strings.Join(paths[:i], ".")+"."+valueField] = ""
+	}
+	update := bson.M{"$set": bson.M{field: data}, "$unset": unset}
 	if data == nil {
-		update = bson.M{"$unset": bson.M{field: ""}}
+		unset[field] = ""
+		update = bson.M{"$unset": unset}
 	}
 
 	// update the field in ancestor document.
@@ -369,98 +595,55 @@ func (c *client) getFromDescendant(ctx context.Context, ref string, query data.Q
 }
 
 func (c *client) getWithQuery(ctx context.Context, ref string, query data.Query) (*dataSnap, error) {
-	// compose a filter based on query.
-	filter, index := bson.M{}, ""
-	switch query.OrderBy {
-	case "$key", ".key":
-		index = "_id"
-	case "$value", ".value":
-		// TODO: not supported now.
-	case "":
-	default:
-		// for nested query, replace the path divider by delimiter.
-		index = strings.Replace(query.OrderBy, "/", ".", -1)
-	}
-	if index != "" {
-		param, param2 := bson.M{}, bson.M{}
-		if query.StartAt != nil {
-			param["$gte"] = query.StartAt
-		}
-		if query.EndAt != nil {
-			param["$lte"] = query.EndAt
-		}
-		if query.StartKey != "" {
-			param2["$gte"] = query.StartKey
-		}
-		if query.EndKey != "" {
-			param2["$lte"] = query.EndKey
-		}
-		if len(param) != 0 {
-			filter[index] = param
-		}
-		if len(param2) != 0 {
-			// if oderByKey and startKey both exist, apply startKey
-			filter["_id"] = param2
-		}
-	}
-
-	var option *options.FindOptions
-	if query.Limit > 0 {
-		sortOrder := 1
-		if query.LimitOrder == "r" {
-			sortOrder = -1
-		}
-		// if index equals, sort by key.
-		sort := bson.D{}
-		if index != "" && index != "_id" {
-			sort = append(sort, bson.E{Key: index, Value: sortOrder})
-		}
-		sort = append(sort, bson.E{Key: "_id", Value: sortOrder})
-		option = options.Find().SetSort(sort).SetLimit(int64(query.Limit))
+	coll := c.Database().Collection(hash(ref))
+
+	// find the documents with query, a single key is looked up directly.
+	var documents map[string]interface{}
+	var err error
+	if (query.OrderBy == "$key" || query.OrderBy == ".key") && query.StartAt != nil && query.EndAt != nil && data.Compare(query.StartAt, query.EndAt) == 0 {
+		documents = map[string]interface{}{}
+		_, err = find(ctx, coll, documents, bson.M{"_id": fmt.Sprint(query.StartAt)})
+	} else {
+		documents, err = findWithQuery(ctx, coll, query)
 	}
-
-	// find the documents with query.
-	cursor, err := c.Database().Collection(hash(ref)).Find(ctx, filter, option)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get %s: %v", ref, err)
 	}
-	defer cursor.Close(ctx)
 
-	// iterate the matched documents.
-	var documents interface{}
-	for cursor.Next(ctx) {
-		var document map[string]interface{}
-		if err := cursor.Decode(&document); err != nil {
-			return nil, fmt.Errorf("failed to decode: %v", err)
+	// select the documents by the range and limit of query, which breaks the ties.
+	var selected interface{}
+	for _, id := range query.Select(documents) {
+		if selected == nil {
+			selected = map[string]interface{}{}
 		}
-		if documents == nil {
-			documents = map[string]interface{}{}
-		}
-		var value interface{} = document
+		var value interface{} = documents[id]
 		if query.Shallow {
 			// handle shallow query.
 			value = true
 		}
-		documents.(map[string]interface{})[document["_id"].(string)] = value
-		// delete the _id in document for response.
-		delete(document, "_id")
+		selected.(map[string]interface{})[id] = value
 	}
 
 	// TODO: check no index by security rule.
 
 	return &dataSnap{
-		val: documents,
+		val: selected,
 	}, nil
 }
 
 func (c *client) createIndex(ctx context.Context, ref string, indexes []string) {
-	// create indexes for collection.
-	indexModels := make([]mongo.IndexModel, len(indexes))
-	for i, index := range indexes {
-		indexModels[i] = mongo.IndexModel{
-			Keys: bson.M{index: 1},
+	// create indexes for collection, which sort the ties by key.
+	var indexModels []mongo.IndexModel
+	for _, index := range indexes {
+		if field := indexField(index); field != "" && field != "_id" {
+			indexModels = append(indexModels, mongo.IndexModel{
+				Keys: bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}},
+			})
 		}
 	}
+	if len(indexModels) == 0 {
+		return
+	}
 	result, err := c.Database().Collection(hash(ref)).Indexes().CreateMany(ctx, indexModels)
 	if err != nil {
 		log.Printf("failed to create index for %s: %v", ref, err)
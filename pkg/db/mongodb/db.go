@@ -14,7 +14,8 @@ import (
 
 type mongoDB struct {
 	*Config
-	rules rules.Rules
+	rules     rules.Rules
+	namespace string
 }
 
 func (m *mongoDB) Connect(ctx context.Context) (db.Client, error) {
@@ -36,6 +37,11 @@ func (m *mongoDB) Connect(ctx context.Context) (db.Client, error) {
 		collTable = m.CollectionsTable
 	}
 
+	// isolate the namespace by database.
+	if m.namespace != "" {
+		database = database + "-" + m.namespace
+	}
+
 	return &client{
 		Client:    mongoClient,
 		rules:     m.rules,
@@ -48,8 +54,8 @@ func (m *mongoDB) SetRules(r rules.Rules) {
 	m.rules = r
 }
 
-// NewDB creates a mongo DB for Flakbase.
-func NewDB(config string) (db.DB, error) {
+// NewDB creates a mongo DB for Flakbase, the database name is suffixed by namespace if given.
+func NewDB(config, namespace string) (db.DB, error) {
 	b, err := ioutil.ReadFile(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read mongo config %s: %v", config, err)
@@ -58,5 +64,5 @@ func NewDB(config string) (db.DB, error) {
 	if err := json.Unmarshal(b, &c); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal mongo config %s: %v", config, err)
 	}
-	return &mongoDB{Config: c}, nil
+	return &mongoDB{Config: c, namespace: namespace}, nil
 }
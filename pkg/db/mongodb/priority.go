@@ -0,0 +1,35 @@
+package mongodb
+
+import "github.com/IguteChung/flakbase/pkg/data"
+
+// The field names to store priorities, since mongo field names cannot start with ".".
+const (
+	priorityField = "#priority"
+	valueField    = "#value"
+)
+
+// encodePriority renames the priority keys of data to be stored.
+func encodePriority(v interface{}) interface{} {
+	return renameKeys(v, map[string]string{data.PriorityKey: priorityField, data.ValueKey: valueField})
+}
+
+// decodePriority renames the priority fields of stored data back.
+func decodePriority(v interface{}) interface{} {
+	return renameKeys(v, map[string]string{priorityField: data.PriorityKey, valueField: data.ValueKey})
+}
+
+// renameKeys copies the data with the keys renamed recursively.
+func renameKeys(v interface{}, names map[string]string) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	renamed := make(map[string]interface{}, len(m))
+	for k, child := range m {
+		if name, ok := names[k]; ok {
+			k = name
+		}
+		renamed[k] = renameKeys(child, names)
+	}
+	return renamed
+}
@@ -0,0 +1,23 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodePriority(t *testing.T) {
+	v := map[string]interface{}{
+		".priority": float64(1),
+		"leaf":      map[string]interface{}{".value": "value", ".priority": "a"},
+		"child":     map[string]interface{}{"key": "value"},
+	}
+	encoded := encodePriority(v)
+	assert.Equal(t, map[string]interface{}{
+		"#priority": float64(1),
+		"leaf":      map[string]interface{}{"#value": "value", "#priority": "a"},
+		"child":     map[string]interface{}{"key": "value"},
+	}, encoded)
+	assert.Equal(t, v, decodePriority(encoded))
+	assert.Equal(t, "value", encodePriority("value"))
+}
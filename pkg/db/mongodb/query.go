@@ -0,0 +1,250 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The brackets of index types in Firebase order, mongo orders the values of different
+// types differently, so the documents are found bracket by bracket.
+const (
+	nullBracket = iota
+	boolBracket
+	numberBracket
+	stringBracket
+	objectBracket
+)
+
+// bracketTypes defines the mongo types of each bracket except null.
+var bracketTypes = map[int]interface{}{
+	boolBracket:   "bool",
+	numberBracket: "number",
+	stringBracket: "string",
+	objectBracket: bson.A{"object", "array"},
+}
+
+// digitsPattern matches the keys which may be 32-bit integers.
+const digitsPattern = "^-?[0-9]+$"
+
+var digitsRegex = regexp.MustCompile(digitsPattern)
+
+// bracketOf returns the bracket of an index value.
+func bracketOf(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return nullBracket
+	case bool:
+		return boolBracket
+	case string:
+		return stringBracket
+	case map[string]interface{}, []interface{}:
+		return objectBracket
+	}
+	return numberBracket
+}
+
+// isIntKey returns true if the key is a 32-bit integer, which is ordered numerically.
+func isIntKey(key string) bool {
+	if !digitsRegex.MatchString(key) {
+		return false
+	}
+	_, err := strconv.ParseInt(key, 10, 32)
+	return err == nil
+}
+
+// indexField returns the document field ordered by query, empty if not supported.
+func indexField(orderBy string) string {
+	switch orderBy {
+	case ".key", "$key":
+		return "_id"
+	case ".value", "$value":
+		return ""
+	case "", ".priority", "$priority":
+		return priorityField
+	}
+	return strings.Join(strings.FieldsFunc(orderBy, func(r rune) bool { return r == '/' || r == '.' }), ".")
+}
+
+// find finds the documents by filter into documents, returns the ids in the order found.
+func find(ctx context.Context, coll *mongo.Collection, documents map[string]interface{}, filter bson.M, opts ...*options.FindOptions) ([]string, error) {
+	cursor, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %+v: %v", filter, err)
+	}
+	defer cursor.Close(ctx)
+
+	var ids []string
+	for cursor.Next(ctx) {
+		var document map[string]interface{}
+		if err := cursor.Decode(&document); err != nil {
+			return nil, fmt.Errorf("failed to decode: %v", err)
+		}
+		// delete the _id in document for response.
+		id := document["_id"].(string)
+		delete(document, "_id")
+		documents[id] = decodePriority(document)
+		ids = append(ids, id)
+	}
+	return ids, cursor.Err()
+}
+
+// findWithQuery finds the documents of collection which may be selected by query, the
+// range, order and limit are applied by mongo, leaving the ties to be broken by keys.
+func findWithQuery(ctx context.Context, coll *mongo.Collection, query data.Query) (map[string]interface{}, error) {
+	documents := map[string]interface{}{}
+	field := indexField(query.OrderBy)
+	switch {
+	case !query.Windowed() || field == "":
+		_, err := find(ctx, coll, documents, bson.M{})
+		return documents, err
+	case field == "_id":
+		return documents, findByKey(ctx, coll, documents, query)
+	case query.StartAt == nil && query.StartKey != "", query.EndAt == nil && query.EndKey != "":
+		// the legacy keys filter regardless of order.
+		_, err := find(ctx, coll, documents, bson.M{})
+		return documents, err
+	}
+
+	// the children of nested index may carry priorities, whose values can be of any
+	// bracket, so they are found first.
+	if field != priorityField {
+		if _, err := find(ctx, coll, documents, bson.M{field: bson.M{"$type": bracketTypes[objectBracket]}}); err != nil {
+			return nil, err
+		}
+	}
+
+	// find the brackets in order until the limit is reached.
+	order := 1
+	brackets := []int{nullBracket, boolBracket, numberBracket, stringBracket}
+	if query.Limit != 0 && query.LimitOrder != "l" {
+		order = -1
+		brackets = []int{stringBracket, numberBracket, boolBracket, nullBracket}
+	}
+	for _, b := range brackets {
+		if query.StartAt != nil && b < bracketOf(query.StartAt) || query.EndAt != nil && b > bracketOf(query.EndAt) {
+			continue
+		}
+		if err := findBracket(ctx, coll, documents, query, field, b, order); err != nil {
+			return nil, err
+		}
+		if query.Limit != 0 && countSelected(documents, query, b, order) >= query.Limit {
+			break
+		}
+	}
+	return documents, nil
+}
+
+// findBracket finds the documents whose index is in bracket and range of query.
+func findBracket(ctx context.Context, coll *mongo.Collection, documents map[string]interface{}, query data.Query, field string, b, order int) error {
+	// the values are all ties in null bracket.
+	if b == nullBracket {
+		_, err := find(ctx, coll, documents, bson.M{field: nil})
+		return err
+	}
+
+	// the range excludes the bounds, whose ties are found all to be broken by keys.
+	cond := bson.M{"$type": bracketTypes[b]}
+	if query.StartAt != nil && bracketOf(query.StartAt) == b {
+		cond["$gt"] = query.StartAt
+		if !query.StartAfter || query.StartKey != "" {
+			if _, err := find(ctx, coll, documents, bson.M{field: query.StartAt}); err != nil {
+				return err
+			}
+		}
+	}
+	if query.EndAt != nil && bracketOf(query.EndAt) == b {
+		cond["$lt"] = query.EndAt
+		if !query.EndBefore || query.EndKey != "" {
+			if _, err := find(ctx, coll, documents, bson.M{field: query.EndAt}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// find the range by index then key, the ties of the last one are found all.
+	opts := options.Find().SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}})
+	if query.Limit != 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	ids, err := find(ctx, coll, documents, bson.M{field: cond}, opts)
+	if err != nil {
+		return err
+	}
+	if query.Limit != 0 && len(ids) == query.Limit {
+		last := ids[len(ids)-1]
+		if _, err := find(ctx, coll, documents, bson.M{field: query.Index(last, documents[last])}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countSelected counts the documents in range of query, whose index is in the brackets
+// found before or at bracket b.
+func countSelected(documents map[string]interface{}, query data.Query, b, order int) int {
+	count := 0
+	for id, document := range documents {
+		index := query.Index(id, document)
+		if (bracketOf(index)-b)*order <= 0 && query.Within(id, index) {
+			count++
+		}
+	}
+	return count
+}
+
+// findByKey finds the documents by the range and limit of keys. The integer keys are
+// ordered numerically before the others which mongo can't sort, so the keys of digits
+// are found all while the others are bounded and limited.
+func findByKey(ctx context.Context, coll *mongo.Collection, documents map[string]interface{}, query data.Query) error {
+	if _, err := find(ctx, coll, documents, bson.M{"_id": bson.M{"$regex": digitsPattern}}); err != nil {
+		return err
+	}
+
+	// the bounds are the keys of startAt and endAt, or the legacy startKey and endKey.
+	start, end := query.StartKey, query.EndKey
+	if query.StartAt != nil {
+		start = fmt.Sprint(query.StartAt)
+	}
+	if query.EndAt != nil {
+		end = fmt.Sprint(query.EndAt)
+	}
+
+	// an integer bound is before all the other keys.
+	cond := bson.M{"$not": primitive.Regex{Pattern: digitsPattern}}
+	if start != "" && !isIntKey(start) {
+		if query.StartAfter {
+			cond["$gt"] = start
+		} else {
+			cond["$gte"] = start
+		}
+	}
+	if end != "" && isIntKey(end) {
+		return nil
+	} else if end != "" {
+		if query.EndBefore {
+			cond["$lt"] = end
+		} else {
+			cond["$lte"] = end
+		}
+	}
+
+	order := 1
+	if query.Limit != 0 && query.LimitOrder != "l" {
+		order = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: order}})
+	if query.Limit != 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	_, err := find(ctx, coll, documents, bson.M{"_id": cond}, opts)
+	return err
+}
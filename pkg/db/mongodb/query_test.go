@@ -0,0 +1,42 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexField(t *testing.T) {
+	assert.Equal(t, "_id", indexField("$key"))
+	assert.Equal(t, "", indexField("$value"))
+	assert.Equal(t, priorityField, indexField(""))
+	assert.Equal(t, priorityField, indexField("$priority"))
+	assert.Equal(t, "a.b", indexField("a/b"))
+}
+
+func TestIsIntKey(t *testing.T) {
+	for _, key := range []string{"0", "-1", "007", "2147483647", "-2147483648"} {
+		assert.True(t, isIntKey(key), key)
+	}
+	for _, key := range []string{"", "a", "+1", "1.5", "2147483648", "99999999999"} {
+		assert.False(t, isIntKey(key), key)
+	}
+}
+
+func TestCountSelected(t *testing.T) {
+	documents := map[string]interface{}{
+		"a": map[string]interface{}{"score": 1},
+		"b": map[string]interface{}{"score": "x"},
+		"c": map[string]interface{}{"score": map[string]interface{}{".value": true, ".priority": 1}},
+		"d": map[string]interface{}{"score": map[string]interface{}{"k": "v"}},
+	}
+	query := data.Query{OrderBy: "score", Limit: 2, LimitOrder: "l"}
+
+	// only the documents in the brackets found are counted.
+	assert.Equal(t, 1, countSelected(documents, query, boolBracket, 1))
+	assert.Equal(t, 2, countSelected(documents, query, numberBracket, 1))
+	assert.Equal(t, 2, countSelected(documents, query, stringBracket, -1))
+	query.StartAt = float64(1)
+	assert.Equal(t, 1, countSelected(documents, query, numberBracket, 1))
+}
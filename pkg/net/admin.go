@@ -0,0 +1,68 @@
+package net
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminPath defines the path prefix of admin api.
+const adminPath = "/.admin/"
+
+// serveAdmin serves the admin api, which is enabled only if admin token configured.
+func (s *handler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	// authorize the request by bearer token.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		writeAdmin(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, adminPath)
+	switch {
+	case route == "redirects" && r.Method == http.MethodGet:
+		writeAdmin(w, http.StatusOK, s.redirects.list())
+	case route == "stats" && r.Method == http.MethodGet:
+		writeAdmin(w, http.StatusOK, s.stats.snapshot())
+	case strings.HasPrefix(route, "redirects/"):
+		status, resp := s.serveRedirect(r, strings.TrimPrefix(route, "redirects/"))
+		writeAdmin(w, status, resp)
+	default:
+		writeAdmin(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+// serveRedirect sets or removes the redirect of a namespace.
+func (s *handler) serveRedirect(r *http.Request, ns string) (int, interface{}) {
+	if !namespaceRegex.MatchString(ns) {
+		return http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid namespace %s", ns)}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Host string `json:"host"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Host == "" {
+			return http.StatusBadRequest, map[string]string{"error": "invalid body, should be {\"host\": \"...\"}"}
+		}
+		s.redirects.set(ns, body.Host)
+		return http.StatusOK, body
+	case http.MethodDelete:
+		s.redirects.remove(ns)
+		return http.StatusOK, nil
+	default:
+		return http.StatusMethodNotAllowed, map[string]string{"error": fmt.Sprintf("not supported method: %s", r.Method)}
+	}
+}
+
+func writeAdmin(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package net
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func admin(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unable to %s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+	status, _ := admin(t, http.MethodGet, server.URL+"/.admin/redirects", "", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	server, _ = newTestServer(t, &Config{AdminToken: "token"})
+	defer server.Close()
+	status, _ = admin(t, http.MethodGet, server.URL+"/.admin/redirects", "invalid", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, body := admin(t, http.MethodGet, server.URL+"/.admin/redirects", "token", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "{}", body)
+}
+
+func TestRedirect(t *testing.T) {
+	server, _ := newTestServer(t, &Config{AdminToken: "token"})
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// connect a client before the namespace moved.
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/?ns=ns1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	receive(t, conn)
+
+	status, _ := admin(t, http.MethodPut, server.URL+"/.admin/redirects/ns1", "token", `{"host":"other:9527"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = admin(t, http.MethodPut, server.URL+"/.admin/redirects/ns1", "token", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// the live connection is redirected and closed.
+	redirect := map[string]interface{}{"t": "c", "d": map[string]interface{}{"t": "r", "d": "other:9527"}}
+	assert.EqualValues(t, redirect, receive(t, conn))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+
+	// new connections and restful requests are redirected as well.
+	conn2, _, err := websocket.DefaultDialer.Dial(url+"/?ns=ns1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn2.Close()
+	assert.EqualValues(t, redirect, receive(t, conn2))
+	status, _ = admin(t, http.MethodGet, server.URL+"/path.json?ns=ns1", "", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, status)
+
+	// other namespaces are not affected.
+	status, _ = admin(t, http.MethodGet, server.URL+"/path.json?ns=ns2", "", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body := admin(t, http.MethodGet, server.URL+"/.admin/redirects", "token", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"ns1":"other:9527"}`, body)
+
+	// remove the redirect.
+	status, _ = admin(t, http.MethodDelete, server.URL+"/.admin/redirects/ns1", "token", "")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = admin(t, http.MethodGet, server.URL+"/path.json?ns=ns1", "", "")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestStats(t *testing.T) {
+	server, _ := newTestServer(t, &Config{AdminToken: "token"})
+	defer server.Close()
+
+	for _, stats := range []string{
+		`{"sdk.js.9-23-0":1}`,
+		`{"sdk.js.9-23-0":1,"framework.cordova":1}`,
+		`{"sdk.admin_node.12-0-0":1}`,
+	} {
+		conn := dial(t, server)
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"s","b":{"c":`+stats+`}}}`)))
+		assert.Equal(t, "ok", receive(t, conn)["d"].(map[string]interface{})["b"].(map[string]interface{})["s"])
+		conn.Close()
+	}
+
+	status, body := admin(t, http.MethodGet, server.URL+"/.admin/stats", "token", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"sdk": {"js": {"9.23.0": 2}, "admin_node": {"12.0.0": 1}},
+		"others": {"framework.cordova": 1}
+	}`, body)
+}
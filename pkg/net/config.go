@@ -1,6 +1,8 @@
 package net
 
 import (
+	"compress/flate"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -12,40 +14,164 @@ import (
 // DefaultPort defines the default port for Flakbase.
 const DefaultPort = ":9527"
 
+// DefaultMaxFrameSize defines the default max size of an outgoing websocket frame.
+const DefaultMaxFrameSize = 16384
+
+// DefaultCompressionLevel defines the default flate level to compress websocket frames.
+const DefaultCompressionLevel = flate.BestSpeed
+
+// DefaultCompressionMinSize defines the default min size of a websocket frame to compress.
+const DefaultCompressionMinSize = 256
+
+// DefaultIdleTimeout defines the default duration to close a silent websocket connection.
+const DefaultIdleTimeout = 60 * time.Second
+
+// DefaultMaxBodySize defines the default max size of a restful request body, which is 256MB.
+const DefaultMaxBodySize = 256 << 20
+
+// DefaultMaxQueueSize defines the default max number of pending outgoing messages of a connection.
+const DefaultMaxQueueSize = 1024
+
+// DefaultMaxNamespaces defines the default max number of namespaces created on demand.
+const DefaultMaxNamespaces = 64
+
 // Config defines the args for a Flakbase server.
 type Config struct {
 	Host  string
 	Rule  string
 	Mongo string
+	// MaxFrameSize defines the size to split outgoing websocket messages, 0 for default.
+	MaxFrameSize int
+	// IdleTimeout defines the duration to treat a websocket connection as dead without
+	// receiving anything, ping is sent at half of it. 0 disables the detection.
+	IdleTimeout time.Duration
+	// Compression enables permessage-deflate if negotiated by client.
+	Compression bool
+	// CompressionLevel defines the flate compression level from -2 to 9, 0 for default.
+	CompressionLevel int
+	// CompressionMinSize defines the min size of a frame to be compressed.
+	CompressionMinSize int
+	// Namespaces defines the namespaces allowed besides the default one, empty to create
+	// any namespace on demand.
+	Namespaces []string
+	// MaxNamespaces defines the max number of namespaces including the default one, 0
+	// for default.
+	MaxNamespaces int
+	// Redirects defines the namespaces redirected to other hosts.
+	Redirects map[string]string
+	// MaxQueueSize defines the max number of pending outgoing messages of a connection,
+	// 0 for default.
+	MaxQueueSize int
+	// SlowConsumer defines the policy when the outbound queue is full, which is either
+	// SlowConsumerCoalesce or SlowConsumerDisconnect, empty for coalesce.
+	SlowConsumer string
+	// CoalesceWindow defines the duration to merge the notifications of a listener
+	// during write bursts, 0 to notify immediately.
+	CoalesceWindow time.Duration
+	// CoalesceMaxDelay defines the max duration to postpone a notification.
+	CoalesceMaxDelay time.Duration
+	// MaxBodySize defines the max size of a restful request body in bytes, 0 for default.
+	MaxBodySize int64
+	// CORSOrigins defines the origins allowed for browsers and websocket upgrades, empty
+	// or "*" for any origin.
+	CORSOrigins []string
+	// CORSMethods defines the methods allowed by cross origin requests, empty for default.
+	CORSMethods []string
+	// CORSHeaders defines the headers allowed by cross origin requests, empty for default.
+	CORSHeaders []string
+	// AdminToken defines the bearer token for admin api, which is disabled if empty.
+	AdminToken string
 }
 
-// Run establishes a http server to handle websocket and rest api.
-func Run(config *Config) {
+// NewHandler creates the http handler of websocket and rest api, the defaults are
+// applied to config.
+func NewHandler(config *Config) (http.Handler, error) {
 	// initiate the websocket upgrader.
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:   16384,
-		WriteBufferSize:  16384,
-		HandshakeTimeout: time.Second * 10,
+		ReadBufferSize:    16384,
+		WriteBufferSize:   16384,
+		HandshakeTimeout:  time.Second * 10,
+		EnableCompression: config.Compression,
 		CheckOrigin: func(r *http.Request) bool {
-			// TODO: check cors
-			return true
+			return config.allowOrigin(r.Header.Get("Origin"))
 		},
 	}
 
-	// create the datastore handler.
-	datastore, err := store.NewHandler(&store.Config{
-		Mongo: config.Mongo,
-		Rule:  config.Rule,
-	})
-	if err != nil {
-		log.Fatalf("failed to new store handler: %v", err)
+	// apply the defaults for namespaces.
+	if config.MaxNamespaces == 0 {
+		config.MaxNamespaces = DefaultMaxNamespaces
+	}
+	allowed := map[string]bool{}
+	for _, ns := range config.Namespaces {
+		if !namespaceRegex.MatchString(ns) {
+			return nil, fmt.Errorf("invalid namespace %s", ns)
+		}
+		allowed[ns] = true
+	}
+
+	// create the datastore handler of default namespace, the others are created lazily.
+	namespaces := &namespaces{
+		allowed: allowed,
+		max:     config.MaxNamespaces,
+		config: store.Config{
+			Mongo: config.Mongo,
+			Rule:  config.Rule,
+
+			CoalesceWindow:   config.CoalesceWindow,
+			CoalesceMaxDelay: config.CoalesceMaxDelay,
+		},
+	}
+	if _, err := namespaces.datastore(""); err != nil {
+		return nil, fmt.Errorf("failed to new store handler: %v", err)
+	}
+
+	// apply the defaults for config.
+	if config.MaxFrameSize == 0 {
+		config.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.CompressionLevel == 0 {
+		config.CompressionLevel = DefaultCompressionLevel
+	} else if config.CompressionLevel < flate.HuffmanOnly || config.CompressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", config.CompressionLevel)
+	}
+	if config.MaxQueueSize == 0 {
+		config.MaxQueueSize = DefaultMaxQueueSize
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = DefaultMaxBodySize
+	}
+	if config.SlowConsumer == "" {
+		config.SlowConsumer = SlowConsumerCoalesce
+	} else if config.SlowConsumer != SlowConsumerCoalesce && config.SlowConsumer != SlowConsumerDisconnect {
+		return nil, fmt.Errorf("invalid slow consumer policy %s", config.SlowConsumer)
 	}
 
 	// generate the handler with config.
 	s := &handler{
-		Config:    config,
-		upgrader:  upgrader,
-		datastore: datastore,
+		Config:     config,
+		upgrader:   upgrader,
+		namespaces: namespaces,
+	}
+
+	// redirect the namespaces moved to other hosts.
+	for ns, host := range config.Redirects {
+		if !namespaceRegex.MatchString(ns) {
+			return nil, fmt.Errorf("invalid namespace to redirect %s", ns)
+		}
+		s.redirects.set(ns, host)
+	}
+
+	return s, nil
+}
+
+// Run establishes a http server to handle websocket and rest api.
+func Run(config *Config) {
+	s, err := NewHandler(config)
+	if err != nil {
+		log.Fatalf("failed to create handler: %v", err)
 	}
 
 	// serve the http handler at root.
@@ -0,0 +1,84 @@
+package net
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultCORSHeaders defines the request headers allowed by cross origin requests by default.
+var defaultCORSHeaders = []string{"Content-Type", "Authorization", "If-Match", "X-Firebase-ETag", "X-HTTP-Method-Override"}
+
+// corsMaxAge defines the seconds for browsers to cache the preflight response.
+const corsMaxAge = "86400"
+
+// allowOrigin checks if the origin is allowed, the requests without origin are not
+// cross origin and always allowed.
+func (c *Config) allowOrigin(origin string) bool {
+	if origin == "" || len(c.CORSOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range c.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMethods returns the methods allowed by cross origin requests.
+func (c *Config) corsMethods() []string {
+	if len(c.CORSMethods) == 0 {
+		return restfulMethods
+	}
+	return c.CORSMethods
+}
+
+// corsHeaders returns the request headers allowed by cross origin requests.
+func (c *Config) corsHeaders() []string {
+	if len(c.CORSHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return c.CORSHeaders
+}
+
+// writeCORS sets the CORS headers of response if the origin is allowed, returns false
+// if the origin is not allowed.
+func (c *Config) writeCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !c.allowOrigin(origin) {
+		return false
+	}
+
+	// echo the origin if not all origins are allowed.
+	if len(c.CORSOrigins) == 0 || contains(c.CORSOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	return true
+}
+
+// servePreflight responds the preflight OPTIONS request with the allowed methods and headers.
+func (c *Config) servePreflight(w http.ResponseWriter, r *http.Request) {
+	if !c.writeCORS(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	methods := strings.Join(append([]string{http.MethodOptions}, c.corsMethods()...), ", ")
+	w.Header().Set("Allow", methods)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.corsHeaders(), ", "))
+	w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package net
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func corsRequest(t *testing.T, method, url, origin string, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("unable to new request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Origin", origin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to %s %s: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPreflight(t *testing.T) {
+	server, _ := newTestServer(t, &Config{CORSOrigins: []string{"https://app.test"}, CORSMethods: []string{http.MethodGet}})
+	defer server.Close()
+
+	header := http.Header{"Access-Control-Request-Method": []string{http.MethodGet}}
+	resp := corsRequest(t, http.MethodOptions, server.URL+"/path.json", "https://app.test", header)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.test", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "OPTIONS, GET", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Content-Type")
+
+	resp = corsRequest(t, http.MethodOptions, server.URL+"/path.json", "https://evil.test", header)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSOrigin(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// any origin is allowed by default.
+	resp := corsRequest(t, http.MethodGet, server.URL+"/path.json", "https://app.test", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	server, _ = newTestServer(t, &Config{CORSOrigins: []string{"https://app.test"}})
+	defer server.Close()
+
+	resp = corsRequest(t, http.MethodGet, server.URL+"/path.json", "https://app.test", nil)
+	assert.Equal(t, "https://app.test", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = corsRequest(t, http.MethodGet, server.URL+"/path.json", "https://evil.test", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// the disallowed origin can't write or stream either.
+	resp = corsRequest(t, http.MethodPut, server.URL+"/path.json", "https://evil.test", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = corsRequest(t, http.MethodGet, server.URL+"/path.json", "https://evil.test", http.Header{"Accept": []string{"text/event-stream"}})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, body := request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, "null", body)
+
+	// the long polling transport is subject to the origins allowed.
+	resp = corsRequest(t, http.MethodGet, server.URL+longPollPath+"?start=t&ser=1&cb=1&v=5", "https://evil.test", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = corsRequest(t, http.MethodGet, server.URL+longPollPath+"?id=unknown&pw=unknown&cb=1", "https://app.test", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://app.test", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	server, _ := newTestServer(t, &Config{CORSOrigins: []string{"https://app.test"}})
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://app.test"}})
+	assert.NoError(t, err)
+	conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://evil.test"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
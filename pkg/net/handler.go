@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -15,172 +19,529 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// transport defines a client connection to read requests and write messages.
+type transport interface {
+	fmt.Stringer
+	// read reads a request from client, returns nil if the message should be skipped.
+	read() (*data.Request, error)
+	// write writes a message to client.
+	write(m data.Message) error
+	// close closes the connection to client.
+	close()
+}
+
 type handler struct {
 	*Config
-	upgrader  websocket.Upgrader
-	datastore store.Handler
+	upgrader   websocket.Upgrader
+	namespaces *namespaces
+	polls      pollSessions
+	redirects  redirects
+	stats      clientStats
+	pushIDs    pushIDs
 }
 
 func (s *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// check if the request can be upgraded to websocket.
 	ctx := r.Context()
+	if strings.HasPrefix(r.URL.Path, adminPath) {
+		s.serveAdmin(w, r)
+		return
+	}
+	if r.URL.Path == longPollPath {
+		// the long polling is a cross origin transport, reject the disallowed origins.
+		if !s.writeCORS(w, r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		pw := &pollResponseWriter{ResponseWriter: w}
+		if err := s.serveLongPoll(pw, r); err != nil {
+			log.Printf("failed to serve long polling: %v", err)
+			// the error can be reported only if nothing has been written.
+			if !pw.written {
+				writeError(w, err)
+			}
+		}
+		return
+	}
+
+	// answer the preflight requests of browsers.
+	if r.Method == http.MethodOptions {
+		s.servePreflight(w, r)
+		return
+	}
+
+	// route the request to the datastore of namespace.
+	ns, err := s.namespace(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// redirect restful requests if the namespace moved to another host.
+	if host := s.redirects.host(ns.name); host != "" && !upgradable(r.Header) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		http.Redirect(w, r, scheme+"://"+host+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	// reject the browsers from the disallowed origins, the websocket upgrader checks
+	// the origin by itself.
+	if !upgradable(r.Header) && !s.writeCORS(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := s.open(ns); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if streamable(r) {
+		if err := s.serveStream(ctx, ns, w, r); err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+
 	if upgradable(r.Header) {
-		if err := s.serveWebsocket(ctx, w, r); err != nil {
+		if err := s.serveWebsocket(ctx, ns, w, r); err != nil {
 			log.Printf("failed to serve websocket: %v", err)
 		}
 		return
 	}
 
 	// serve restful api.
-	// TODO: enable cors now.
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	if err := s.serveRestful(ctx, w, r); err != nil {
-		// not handled error.
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	if err := s.serveRestful(ctx, ns, w, r); err != nil {
+		// respond the error with status by its kind.
+		writeError(w, err)
 	}
 }
 
-func (s *handler) serveWebsocket(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+func (s *handler) serveWebsocket(ctx context.Context, ns *namespace, w http.ResponseWriter, r *http.Request) error {
 	// upgrade the http connection to websocket.
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(&countingResponseWriter{ResponseWriter: w}, r, nil)
 	if err != nil {
 		return fmt.Errorf("failed to upgrade websocket: %v", err)
 	}
 	defer conn.Close()
 
+	t := newWebsocketTransport(conn, s.Config)
+	defer t.close()
+	return s.serve(ctx, ns, t)
+}
+
+// serve handles the requests from a client connection until the transport broke.
+func (s *handler) serve(ctx context.Context, ns *namespace, t transport) error {
 	// prepare send util and lock to avoid concurrent write.
 	mux := sync.Mutex{}
 	send := func(m data.Message) error {
 		mux.Lock()
 		defer mux.Unlock()
-		log.Printf("[message sent] %+v", conn.RemoteAddr())
-		return conn.WriteJSON(m.Format())
+		log.Printf("[message sent] %s", t)
+		return t.write(m)
+	}
+
+	// redirect the connection if the namespace moved to another host.
+	if host := s.redirects.track(ns.name, t, func(host string) { redirect(t, send, host) }); host != "" {
+		redirect(t, send, host)
+		return nil
+	}
+	defer s.redirects.untrack(ns.name, t)
+
+	// the redirect may be removed since the namespace was resolved.
+	if ns.datastore == nil {
+		datastore, err := s.namespaces.datastore(ns.name)
+		if err != nil {
+			return fmt.Errorf("failed to get datastore: %v", err)
+		}
+		ns.datastore = datastore
 	}
 
 	// send initial message.
-	if err := send(data.InitMessage{Now: time.Now(), Host: s.Host}); err != nil {
+	init := data.InitMessage{Now: time.Now(), Host: ns.host}
+	if err := send(init); err != nil {
 		return fmt.Errorf("failed to send initial message: %v", err)
 	}
 
-	// generate listen channel.
+	// queue the outgoing messages so that the datastore never blocks on a slow client,
+	// a client falling too far behind is disconnected with an error.
+	out := newOutbox(s.MaxQueueSize, s.SlowConsumer)
+	var overflow sync.Once
+	enqueue := func(m data.Message) error {
+		err := out.push(m)
+		if err == errQueueFull {
+			overflow.Do(func() {
+				metrics.Add(metricSlowConsumers, 1)
+				go func() {
+					if err := send(data.ErrorMessage{Reason: "client is too slow to receive messages"}); err != nil {
+						log.Printf("failed to send error message to %s: %v", t, err)
+					}
+					t.close()
+				}()
+			})
+		}
+		return err
+	}
+	go func() {
+		for msg, ok := out.pop(); ok; msg, ok = out.pop() {
+			if err := send(msg); err != nil {
+				log.Printf("failed to send message: %v", err)
+			}
+		}
+	}()
+
+	// generate listen channel and register the connection.
 	ch := make(store.ListenChannel)
+	if err := ns.datastore.HandleConnect(ctx, ch); err != nil {
+		out.close()
+		return fmt.Errorf("failed to handle connect: %v", err)
+	}
 	go func() {
+		defer out.close()
 		for msg := range ch {
-			if err := send(msg); err != nil {
-				log.Printf("failed to send listen message: %v", err)
+			if err := enqueue(msg); err != nil {
+				log.Printf("failed to queue listen message to %s: %v", t, err)
 			}
 		}
 	}()
 
+	// if connection broke, wait for the handling requests, then unlisten all and
+	// apply the onDisconnect requests before closing the listen channel.
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		if err := ns.datastore.HandleDisconnect(ctx, ch); err != nil {
+			log.Printf("failed to handle disconnect %s: %v", t, err)
+		}
+		close(ch)
+	}()
+
 	// iterating on receiving client messages.
+	seq := newSequencer()
 	for {
 		// read a request from connection.
-		r, err := readMessage(conn)
+		r, err := t.read()
 		if err != nil {
 			return fmt.Errorf("failed to read message: %v", err)
 		} else if r == nil {
 			continue
 		}
-		log.Printf("[message received] %+v: %+v", conn.RemoteAddr(), r)
+		log.Printf("[message received] %s: %+v", t, r)
 
-		// handle the request asynchronously.
+		// handle the request asynchronously in the order scheduled.
+		wait, done := seq.schedule(r)
+		wg.Add(1)
 		go func() {
-			// handle the request by request type.
-			var err error
-			result := &store.ListenResult{}
-			switch r.Type {
-			case data.TypeSet:
-				err = s.datastore.HandleSet(ctx, r.Ref, r.Data)
-			case data.TypeUpdate:
-				err = s.datastore.HandleUpdate(ctx, r.Ref, r.Data)
-			case data.TypeListen:
-				result, err = s.datastore.HandleListen(ctx, r.Ref, r.Query, ch)
-				defer s.datastore.HandleUnlisten(ctx, r.Ref, r.Query, ch)
-			case data.TypeUnlisten:
-				err = s.datastore.HandleUnlisten(ctx, r.Ref, r.Query, ch)
-			case data.TypeIdle:
-				// send idle message.
-				if err := send(data.IdleMessage{}); err != nil {
-					log.Printf("failed to send idle message: %v", err)
-				}
-				return
-			}
-			if err != nil {
-				// request not properly handled.
-				log.Printf("failed to handle request %+v: %v", r, err)
-			}
-
-			// send ok message.
-			if err := send(data.OkMessage{RequestID: r.RequestID, NoIndex: result.NoIndex}); err != nil {
-				log.Printf("failed to send ok message: %v", err)
-			}
+			defer wg.Done()
+			defer done()
+			wait()
+			s.handleRequest(ctx, ns.datastore, r, ch, enqueue)
 		}()
+	}
+}
 
-		// unlisten if connection broke.
-		if r.Type == data.TypeListen {
-			defer s.datastore.HandleUnlisten(ctx, r.Ref, r.Query, ch)
+// handleRequest handles a client request and sends the response.
+func (s *handler) handleRequest(ctx context.Context, datastore store.Handler, r *data.Request, ch store.ListenChannel, send func(data.Message) error) {
+	// handle the request by request type.
+	var err error
+	result := &store.ListenResult{}
+	switch r.Type {
+	case data.TypeSet:
+		if r.Hash == nil {
+			err = datastore.HandleSet(ctx, r.Ref, r.Data)
+			break
+		}
+
+		// reject the transaction if the current data changed.
+		var ok bool
+		if _, ok, err = datastore.HandleSetIf(ctx, r.Ref, r.Data, *r.Hash); err == nil && !ok {
+			if err := send(data.StaleMessage{RequestID: r.RequestID}); err != nil {
+				log.Printf("failed to send stale message: %v", err)
+			}
+			return
+		}
+	case data.TypeUpdate:
+		err = datastore.HandleUpdate(ctx, r.Ref, r.Data)
+	case data.TypeListen:
+		if result, err = datastore.HandleListen(ctx, r.Ref, r.Query, ch); result == nil {
+			result = &store.ListenResult{}
+		}
+	case data.TypeUnlisten:
+		err = datastore.HandleUnlisten(ctx, r.Ref, r.Query, ch)
+	case data.TypeDisconnectSet, data.TypeDisconnectUpdate, data.TypeDisconnectCancel:
+		err = datastore.HandleOnDisconnect(ctx, *r, ch)
+	case data.TypeStats:
+		s.stats.record(r.Stats)
+	case data.TypeGet:
+		// send the data along with the response.
+		var msg data.Message
+		resp, err := datastore.HandleGet(ctx, r.Ref, r.Query, ch)
+		if err != nil {
+			log.Printf("failed to handle request %+v: %v", r, err)
+			msg = failedMessage(r.RequestID, err)
+		} else {
+			msg = data.GetMessage{RequestID: r.RequestID, Data: resp}
+		}
+		if err := send(msg); err != nil {
+			log.Printf("failed to send get message: %v", err)
+		}
+		return
+	case data.TypeIdle:
+		// send idle message.
+		if err := send(data.IdleMessage{}); err != nil {
+			log.Printf("failed to send idle message: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		// request not properly handled, report the failure instead of ok.
+		log.Printf("failed to handle request %+v: %v", r, err)
+		if err := send(failedMessage(r.RequestID, err)); err != nil {
+			log.Printf("failed to send failed message: %v", err)
 		}
+		return
+	}
 
+	// send ok message.
+	if err := send(data.OkMessage{RequestID: r.RequestID, NoIndex: result.NoIndex}); err != nil {
+		log.Printf("failed to send ok message: %v", err)
 	}
 }
 
-func (s *handler) serveRestful(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+func (s *handler) serveRestful(ctx context.Context, ns *namespace, w http.ResponseWriter, r *http.Request) (err error) {
 	// check url is valid.
 	u := r.URL.Path
 	if !strings.HasSuffix(u, ".json") {
-		return fmt.Errorf("invalid path %s, should end with .json", u)
+		return data.Errorf(data.KindNotFound, "invalid path %s, should end with .json", u)
 	}
 
 	// truncate .json to get path ref.
 	ref := u[:len(u)-len(".json")]
 
+	// parse the output format.
+	output, err := ParseOutput(r.URL.Query())
+	if err != nil {
+		return data.Errorf(data.KindInvalid, "invalid output: %v", err)
+	}
+
+	// bound the request by timeout if given.
+	limits, err := ParseLimits(r.URL.Query())
+	if err != nil {
+		return data.Errorf(data.KindInvalid, "invalid limits: %v", err)
+	}
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = data.Errorf(data.KindTimeout, "request exceeded timeout %s", limits.Timeout)
+			}
+		}()
+	}
+
 	// handle the request by method.
-	switch r.Method {
+	var resp interface{}
+	switch method := restfulMethod(r); method {
 	case http.MethodGet:
 		query, err := ParseQuery(r.URL.Query())
 		if err != nil {
-			return fmt.Errorf("invalid query: %v", err)
+			return data.Errorf(data.KindInvalid, "invalid query: %v", err)
 		}
 
 		// get the data from store.
-		data, err := s.datastore.HandleGet(ctx, ref, *query)
-		if err != nil {
-			return fmt.Errorf("failed to handle get %s: %v", ref, err)
+		if resp, err = ns.datastore.HandleGet(ctx, ref, *query, nil); err != nil {
+			return data.Wrapf(err, "failed to handle get %s", ref)
 		}
 
-		// marshal the data to bytes for response.
-		bytes, err := json.Marshal(data)
-		if err != nil {
-			return fmt.Errorf("failed to marshal response: %v", err)
+		// respond the ETag for conditional requests if asked.
+		if r.Header.Get("X-Firebase-ETag") == "true" {
+			w.Header().Set("ETag", etag(resp))
 		}
-		w.Write(bytes)
+		return writeRestful(w, output, resp)
 	case http.MethodPut, http.MethodPatch:
 		// decode the json body for set or update.
-		var data interface{}
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			return fmt.Errorf("failed to unmarshal body: %v", err)
+		value, err := s.decodeBody(r)
+		if err != nil {
+			return err
+		}
+		overwritten := []string{ref}
+		if children, ok := value.(map[string]interface{}); ok && method == http.MethodPatch {
+			// an update overwrites each patched child only.
+			overwritten = nil
+			for k := range children {
+				overwritten = append(overwritten, path.Join(ref, k))
+			}
+		}
+		if err := checkWriteSize(ctx, ns.datastore, limits, value, overwritten...); err != nil {
+			return err
 		}
 
 		// call set or update according to method.
-		if r.Method == http.MethodPut {
-			if err := s.datastore.HandleSet(ctx, ref, data); err != nil {
-				return fmt.Errorf("failed to handle set %s: %v", ref, err)
+		if method == http.MethodPut {
+			if ok, err := setRestful(ctx, ns.datastore, w, r, output, ref, value); err != nil {
+				return data.Wrapf(err, "failed to handle set %s", ref)
+			} else if !ok {
+				return nil
 			}
 		} else {
-			if err := s.datastore.HandleUpdate(ctx, ref, data); err != nil {
-				return fmt.Errorf("failed to handle update %s: %v", ref, err)
+			if err := ns.datastore.HandleUpdate(ctx, ref, value); err != nil {
+				return data.Wrapf(err, "failed to handle update %s", ref)
 			}
 		}
+
+		// respond the written data.
+		resp = value
+	case http.MethodPost:
+		// decode the json body to push.
+		value, err := s.decodeBody(r)
+		if err != nil {
+			return err
+		}
+		if err := checkWriteSize(ctx, ns.datastore, limits, value); err != nil {
+			return err
+		}
+
+		// set the data under a generated push id.
+		name := s.pushIDs.next()
+		if err := ns.datastore.HandleSet(ctx, path.Join(ref, name), value); err != nil {
+			return data.Wrapf(err, "failed to handle push %s", ref)
+		}
+
+		// respond the name of pushed child.
+		resp = map[string]string{"name": name}
 	case http.MethodDelete:
-		if err := s.datastore.HandleSet(ctx, ref, nil); err != nil {
-			return fmt.Errorf("failed to handle remove %s: %v", ref, err)
+		if err := checkWriteSize(ctx, ns.datastore, limits, nil, ref); err != nil {
+			return err
+		}
+		if ok, err := setRestful(ctx, ns.datastore, w, r, output, ref, nil); err != nil {
+			return data.Wrapf(err, "failed to handle remove %s", ref)
+		} else if !ok {
+			return nil
 		}
 	default:
-		return fmt.Errorf("not supported method: %s", r.Method)
+		w.Header().Set("Allow", strings.Join(restfulMethods, ", "))
+		return data.Errorf(data.KindMethod, "not supported method: %s", method)
 	}
 
+	// suppress the response of writes if silent.
+	if output.Silent {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return writeRestful(w, output, resp)
+}
+
+// setRestful sets the data, or compares and sets if the ETag of current data is given
+// by "if-match" header. It responds 412 with the current data if not matched.
+func setRestful(ctx context.Context, datastore store.Handler, w http.ResponseWriter, r *http.Request, output *Output, ref string, value interface{}) (bool, error) {
+	ifMatch := strings.Trim(r.Header.Get("if-match"), `"`)
+	if ifMatch == "" {
+		return true, datastore.HandleSet(ctx, ref, value)
+	}
+
+	// the hash of null data is empty.
+	hash := ifMatch
+	if hash == nullETag {
+		hash = ""
+	}
+	current, ok, err := datastore.HandleSetIf(ctx, ref, value, hash)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		w.Header().Set("ETag", etag(current))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false, writeRestful(w, output, current)
+	}
+	w.Header().Set("ETag", etag(value))
+	return true, nil
+}
+
+// checkWriteSize rejects the write larger than the write size limit, the size counts
+// both the written data and the data overwritten at the references.
+func checkWriteSize(ctx context.Context, datastore store.Handler, limits *Limits, value interface{}, overwritten ...string) error {
+	if limits.WriteSize == 0 {
+		return nil
+	}
+
+	size, err := jsonSize(value)
+	if err != nil {
+		return err
+	}
+	for _, ref := range overwritten {
+		current, err := datastore.HandleGet(ctx, ref, data.Query{}, nil)
+		if err != nil {
+			return data.Wrapf(err, "failed to get overwritten data %s", ref)
+		}
+		currentSize, err := jsonSize(current)
+		if err != nil {
+			return err
+		}
+		size += currentSize
+	}
+	if size > limits.WriteSize {
+		return data.Errorf(data.KindTooLarge, "Data to write exceeds the maximum size that can be modified with a single request.")
+	}
+	return nil
+}
+
+// jsonSize returns the size of data in json.
+func jsonSize(v interface{}) (int64, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal data: %v", err)
+	}
+	return int64(len(b)), nil
+}
+
+// decodeBody reads the json body of request, which is no larger than the max body size.
+func (s *handler) decodeBody(r *http.Request) (interface{}, error) {
+	body := io.Reader(r.Body)
+	if s.MaxBodySize > 0 {
+		body = io.LimitReader(r.Body, s.MaxBodySize+1)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if s.MaxBodySize > 0 && int64(len(b)) > s.MaxBodySize {
+		return nil, data.Errorf(data.KindTooLarge, "request body exceeds %d bytes", s.MaxBodySize)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return nil, data.Errorf(data.KindInvalid, "Invalid data; couldn't parse JSON object, array, or value.")
+	}
+	return value, nil
+}
+
+// writeRestful writes the data as a restful response in the output format, the
+// priorities are included only for export format.
+func writeRestful(w http.ResponseWriter, output *Output, value interface{}) error {
+	if !output.Export {
+		value = data.StripPriority(value)
+	}
+
+	// marshal the data to bytes for response.
+	var bytes []byte
+	var err error
+	if output.Pretty {
+		bytes, err = json.MarshalIndent(value, "", "  ")
+	} else {
+		bytes, err = json.Marshal(value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	// save the response as a file if download specified.
+	if output.Download != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": output.Download}))
+	}
+	w.Write(bytes)
 	return nil
 }
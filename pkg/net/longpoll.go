@@ -0,0 +1,359 @@
+package net
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+// longPollPath defines the request path for long polling transport.
+const longPollPath = "/.lp"
+
+const (
+	// pollTimeout defines the max duration to hold a poll request without outgoing messages.
+	pollTimeout = 25 * time.Second
+	// pollSessionTimeout defines the duration to close a session without any poll request.
+	pollSessionTimeout = 60 * time.Second
+)
+
+// errSessionClosed implies the long polling session is closed.
+var errSessionClosed = errors.New("session closed")
+
+// pollSegment defines a segment of client payload, a payload may be splitted into
+// several segments across requests due to the limit of url length.
+type pollSegment struct {
+	total   int
+	payload string
+}
+
+// pollSession defines the transport over long polling requests.
+type pollSession struct {
+	id       string
+	password string
+	callback string
+
+	mux      sync.Mutex
+	segments map[int]pollSegment
+	nextSeg  int
+	outgoing []data.Message
+	serial   int
+
+	requests  chan *data.Request
+	notify    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	timer     *time.Timer
+}
+
+func newPollSession(callback string) (*pollSession, error) {
+	// generate random id and password.
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %v", err)
+	}
+
+	p := &pollSession{
+		id:       hex.EncodeToString(b[:8]),
+		password: hex.EncodeToString(b[8:]),
+		callback: callback,
+		segments: map[int]pollSegment{},
+		requests: make(chan *data.Request),
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	p.timer = time.AfterFunc(pollSessionTimeout, p.close)
+	return p, nil
+}
+
+func (p *pollSession) read() (*data.Request, error) {
+	select {
+	case r := <-p.requests:
+		return r, nil
+	case <-p.closed:
+		return nil, errSessionClosed
+	}
+}
+
+func (p *pollSession) write(m data.Message) error {
+	select {
+	case <-p.closed:
+		return errSessionClosed
+	default:
+	}
+
+	p.mux.Lock()
+	p.outgoing = append(p.outgoing, m)
+	p.mux.Unlock()
+
+	// wake up one of the pending polls.
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (p *pollSession) String() string {
+	return "lp:" + p.id
+}
+
+func (p *pollSession) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// receive collects the segments from query and dispatches the completed payloads.
+func (p *pollSession) receive(q url.Values) error {
+	// keep the session alive.
+	p.timer.Reset(pollSessionTimeout)
+
+	p.mux.Lock()
+	for i := 0; ; i++ {
+		seg, total, payload := q.Get("seg"+strconv.Itoa(i)), q.Get("ts"+strconv.Itoa(i)), q.Get("d"+strconv.Itoa(i))
+		if seg == "" {
+			break
+		}
+		n, err := strconv.Atoi(seg)
+		if err != nil {
+			p.mux.Unlock()
+			return fmt.Errorf("invalid segment number %s: %v", seg, err)
+		}
+		t, err := strconv.Atoi(total)
+		if err != nil || t <= 0 {
+			p.mux.Unlock()
+			return fmt.Errorf("invalid segment total %s: %v", total, err)
+		}
+		p.segments[n] = pollSegment{total: t, payload: payload}
+	}
+
+	// concat the segments in order until an incomplete payload.
+	var payloads []string
+	for {
+		first, ok := p.segments[p.nextSeg]
+		if !ok {
+			break
+		}
+		var buffer strings.Builder
+		complete := true
+		for i := 0; i < first.total && complete; i++ {
+			segment, ok := p.segments[p.nextSeg+i]
+			buffer.WriteString(segment.payload)
+			complete = ok
+		}
+		if !complete {
+			break
+		}
+		for i := 0; i < first.total; i++ {
+			delete(p.segments, p.nextSeg+i)
+		}
+		p.nextSeg += first.total
+		payloads = append(payloads, buffer.String())
+	}
+	p.mux.Unlock()
+
+	// dispatch the payloads, which are encoded in web safe base64.
+	for _, payload := range payloads {
+		bytes, err := decodeSegment(payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode payload %s: %v", payload, err)
+		}
+		r := unmarshalRequest(bytes)
+		if r == nil {
+			continue
+		}
+		select {
+		case p.requests <- r:
+		case <-p.closed:
+			return errSessionClosed
+		}
+	}
+	return nil
+}
+
+// poll waits for the outgoing messages and writes them as a script response.
+func (p *pollSession) poll(w http.ResponseWriter, timeout time.Duration) error {
+	defer p.timer.Reset(pollSessionTimeout)
+
+	// wait for any outgoing message.
+	p.mux.Lock()
+	pending := len(p.outgoing)
+	p.mux.Unlock()
+	if pending == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-p.notify:
+		case <-timer.C:
+		case <-p.closed:
+		}
+	}
+
+	// take all outgoing messages with a response serial number, a closed session
+	// flushes the remaining messages before the close command.
+	closed := false
+	select {
+	case <-p.closed:
+		closed = true
+	default:
+	}
+	p.mux.Lock()
+	messages, serial := p.outgoing, p.serial
+	p.outgoing = nil
+	if len(messages) > 0 || !closed {
+		p.serial++
+	}
+	p.mux.Unlock()
+
+	if len(messages) > 0 || !closed {
+		formatted := make([]data.O, len(messages))
+		for i, m := range messages {
+			formatted[i] = m.Format()
+		}
+		bytes, err := json.Marshal(formatted)
+		if err != nil {
+			return fmt.Errorf("failed to marshal messages: %v", err)
+		}
+		if _, err := fmt.Fprintf(w, "pRTLPCB%s(%d,%s);", p.callback, serial, bytes); err != nil {
+			return err
+		}
+	}
+	if closed {
+		_, err := fmt.Fprintf(w, "pLPCommand%s('close');", p.callback)
+		return err
+	}
+	return nil
+}
+
+// decodeSegment decodes the web safe base64 string used by Firebase clients.
+func decodeSegment(s string) ([]byte, error) {
+	s = strings.NewReplacer("-", "+", "_", "/", ".", "=").Replace(s)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// pollSessions defines the registry of long polling sessions.
+type pollSessions struct {
+	sync.Mutex
+	s map[string]*pollSession
+}
+
+func (p *pollSessions) add(session *pollSession) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.s == nil {
+		p.s = map[string]*pollSession{}
+	}
+	p.s[session.id] = session
+}
+
+func (p *pollSessions) remove(id string) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.s, id)
+}
+
+func (p *pollSessions) get(id, password string) *pollSession {
+	p.Lock()
+	defer p.Unlock()
+
+	if session, ok := p.s[id]; ok && session.password == password {
+		return session
+	}
+	return nil
+}
+
+// pollResponseWriter records whether the response of a poll has been written.
+type pollResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *pollResponseWriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *pollResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (s *handler) serveLongPoll(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// the callback is written into script, allow only identifier characters.
+	if cb := q.Get("cb"); strings.IndexFunc(cb, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_')
+	}) >= 0 {
+		return data.Errorf(data.KindInvalid, "invalid callback %s", cb)
+	}
+
+	// start a new session in the namespace.
+	if q.Get("start") == "t" {
+		ns, err := s.namespace(r)
+		if err != nil {
+			return data.Wrapf(err, "failed to resolve namespace")
+		}
+		if err := s.open(ns); err != nil {
+			return err
+		}
+		session, err := newPollSession(q.Get("cb"))
+		if err != nil {
+			return fmt.Errorf("failed to create session: %v", err)
+		}
+		s.polls.add(session)
+
+		// serve the session in background since it outlives the request.
+		go func() {
+			defer s.polls.remove(session.id)
+			defer session.close()
+			if err := s.serve(context.Background(), ns, session); err != nil {
+				log.Printf("failed to serve long polling %s: %v", session, err)
+			}
+		}()
+
+		// respond the session credential along with the initial message.
+		if _, err := fmt.Fprintf(w, "pLPCommand%s('start','%s','%s');", session.callback, session.id, session.password); err != nil {
+			return fmt.Errorf("failed to write start command: %v", err)
+		}
+		return session.poll(w, pollTimeout)
+	}
+
+	// find the existing session.
+	session := s.polls.get(q.Get("id"), q.Get("pw"))
+	if session == nil {
+		_, err := fmt.Fprintf(w, "pLPCommand%s('close');", q.Get("cb"))
+		return err
+	}
+
+	// close the session by the disconnect frame.
+	if q.Get("dframe") == "t" || q.Get("disconn") == "t" {
+		session.close()
+		return nil
+	}
+
+	// handle the client payloads then hold the request as a poll.
+	if err := session.receive(q); err == errSessionClosed {
+		return data.Errorf(data.KindNotFound, "failed to receive from %s: %v", session, err)
+	} else if err != nil {
+		return data.Errorf(data.KindInvalid, "failed to receive from %s: %v", session, err)
+	}
+	return session.poll(w, pollTimeout)
+}
@@ -0,0 +1,122 @@
+package net
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	startRegex = regexp.MustCompile(`^pLPCommand1\('start','(\w+)','(\w+)'\);`)
+	dataRegex  = regexp.MustCompile(`pRTLPCB1\((\d+),(.*)\);$`)
+)
+
+func longPoll(t *testing.T, server string, q url.Values) string {
+	resp, err := http.Get(server + longPollPath + "?" + q.Encode())
+	if err != nil {
+		t.Fatalf("unable to long poll: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	return string(b)
+}
+
+func pollMessages(t *testing.T, body string) (string, []map[string]interface{}) {
+	matches := dataRegex.FindStringSubmatch(body)
+	if matches == nil {
+		t.Fatalf("invalid poll response: %s", body)
+	}
+	var messages []map[string]interface{}
+	if err := json.Unmarshal([]byte(matches[2]), &messages); err != nil {
+		t.Fatalf("unable to unmarshal messages %s: %v", matches[2], err)
+	}
+	return matches[1], messages
+}
+
+func encodeSegment(s string) string {
+	return strings.NewReplacer("+", "-", "/", "_", "=", ".").Replace(base64.StdEncoding.EncodeToString([]byte(s)))
+}
+
+func TestLongPoll(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// start a session and receive the initial message.
+	body := longPoll(t, server.URL, url.Values{"start": {"t"}, "ser": {"1"}, "cb": {"1"}, "v": {"5"}})
+	matches := startRegex.FindStringSubmatch(body)
+	if !assert.NotNil(t, matches) {
+		return
+	}
+	id, pw := matches[1], matches[2]
+	serial, messages := pollMessages(t, body)
+	assert.Equal(t, "0", serial)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "c", messages[0]["t"])
+
+	// send a set request splitted into two segments.
+	payload := encodeSegment(`{"t":"d","d":{"r":1,"a":"p","b":{"p":"/path","d":"value"}}}`)
+	body = longPoll(t, server.URL, url.Values{
+		"id": {id}, "pw": {pw}, "ser": {"2"}, "cb": {"1"},
+		"seg0": {"0"}, "ts0": {"2"}, "d0": {payload[:10]},
+		"seg1": {"1"}, "ts1": {"2"}, "d1": {payload[10:]},
+	})
+	serial, messages = pollMessages(t, body)
+	assert.Equal(t, "1", serial)
+	assert.EqualValues(t, []map[string]interface{}{{
+		"t": "d",
+		"d": map[string]interface{}{
+			"r": float64(1),
+			"b": map[string]interface{}{"s": "ok", "d": map[string]interface{}{}},
+		},
+	}}, messages)
+
+	// get the data with the next segment.
+	body = longPoll(t, server.URL, url.Values{
+		"id": {id}, "pw": {pw}, "ser": {"3"}, "cb": {"1"},
+		"seg0": {"2"}, "ts0": {"1"}, "d0": {encodeSegment(`{"t":"d","d":{"r":2,"a":"g","b":{"p":"/path"}}}`)},
+	})
+	serial, messages = pollMessages(t, body)
+	assert.Equal(t, "2", serial)
+	assert.EqualValues(t, []map[string]interface{}{{
+		"t": "d",
+		"d": map[string]interface{}{
+			"r": float64(2),
+			"b": map[string]interface{}{"s": "ok", "d": "value"},
+		},
+	}}, messages)
+
+	// close the session by the disconnect frame.
+	longPoll(t, server.URL, url.Values{"id": {id}, "pw": {pw}, "dframe": {"t"}})
+	body = longPoll(t, server.URL, url.Values{"id": {id}, "pw": {pw}, "ser": {"4"}, "cb": {"1"}})
+	assert.Equal(t, "pLPCommand1('close');", body)
+}
+
+func TestLongPollInvalidCallback(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + longPollPath + "?" + url.Values{"start": {"t"}, "cb": {"alert(1)"}}.Encode())
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLongPollInvalidNamespace(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// the error is reported with the status of its kind.
+	status, body := request(t, http.MethodGet, server.URL+longPollPath+"?"+url.Values{"start": {"t"}, "cb": {"1"}, "ns": {"../ns1"}}.Encode(), "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "invalid namespace")
+}
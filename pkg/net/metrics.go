@@ -0,0 +1,54 @@
+package net
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+)
+
+// metrics defines the counters of Flakbase server, exported at /debug/vars.
+var metrics = expvar.NewMap("flakbase")
+
+const (
+	// metricWebsocketBytes counts the bytes of outgoing websocket payloads before compression.
+	metricWebsocketBytes = "websocket_bytes"
+	// metricWebsocketWireBytes counts the bytes written to websocket connections, which
+	// are compressed if negotiated and include the framing.
+	metricWebsocketWireBytes = "websocket_wire_bytes"
+	// metricQueueDepth gauges the pending outgoing messages of all connections.
+	metricQueueDepth = "queue_depth"
+	// metricQueueCoalesced counts the outgoing messages replaced by newer ones.
+	metricQueueCoalesced = "queue_coalesced"
+	// metricSlowConsumers counts the connections closed for a full outbound queue.
+	metricSlowConsumers = "slow_consumers"
+)
+
+// countingConn counts the bytes written to the network connection.
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	metrics.Add(metricWebsocketWireBytes, int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to the hijacked connection.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn}, brw, nil
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/IguteChung/flakbase/pkg/store"
+)
+
+// namespaceRegex defines the valid namespace name, which is also used in database names.
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,47}$`)
+
+// namespace defines an isolated database selected by request.
+type namespace struct {
+	// name defines the namespace name, empty for the default namespace.
+	name string
+	// host defines the host name reported to client in handshake.
+	host      string
+	datastore store.Handler
+}
+
+// namespaces defines the datastores for each namespace, which are created lazily.
+type namespaces struct {
+	sync.Mutex
+	config store.Config
+	h      map[string]store.Handler
+	// allowed defines the namespaces allowed to create, empty for any namespace.
+	allowed map[string]bool
+	// max defines the max number of datastores, 0 for unlimited.
+	max int
+}
+
+// datastore gets the datastore of namespace, creates one if not exists.
+func (n *namespaces) datastore(name string) (store.Handler, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if h, ok := n.h[name]; ok {
+		return h, nil
+	}
+
+	// the default namespace is always available.
+	if name != "" && len(n.allowed) > 0 && !n.allowed[name] {
+		return nil, data.Errorf(data.KindNotFound, "namespace %s not found", name)
+	}
+	if name != "" && n.max > 0 && len(n.h) >= n.max {
+		return nil, data.Errorf(data.KindNotFound, "namespace %s not found: too many namespaces", name)
+	}
+
+	// create the datastore with namespace.
+	config := n.config
+	config.Namespace = name
+	h, err := store.NewHandler(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new store handler for namespace %s: %v", name, err)
+	}
+	if n.h == nil {
+		n.h = map[string]store.Handler{}
+	}
+	n.h[name] = h
+	return h, nil
+}
+
+// namespace resolves the namespace of request by the ns parameter or the subdomain of
+// host, the datastore is opened separately.
+func (s *handler) namespace(r *http.Request) (*namespace, error) {
+	name, host := r.URL.Query().Get("ns"), s.Host
+	if suffix := "." + s.Host; name == "" && s.Host != "" && strings.HasSuffix(r.Host, suffix) {
+		name, host = strings.TrimSuffix(r.Host, suffix), r.Host
+	} else if name != "" && s.Host != "" {
+		// report the subdomain of namespace so that client reconnects to it.
+		host = name + "." + s.Host
+	}
+	if name != "" && !namespaceRegex.MatchString(name) {
+		return nil, data.Errorf(data.KindInvalid, "invalid namespace %s", name)
+	}
+
+	return &namespace{name: name, host: host}, nil
+}
+
+// open opens the datastore of namespace if it's served locally, the namespace redirected
+// to another host never creates one.
+func (s *handler) open(ns *namespace) error {
+	if ns.datastore != nil || s.redirects.host(ns.name) != "" {
+		return nil
+	}
+	datastore, err := s.namespaces.datastore(ns.name)
+	if err != nil {
+		return data.Wrapf(err, "failed to get datastore")
+	}
+	ns.datastore = datastore
+	return nil
+}
@@ -0,0 +1,119 @@
+package net
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, method, url, host, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to new request: %v", err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to %s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestNamespaces(t *testing.T) {
+	server, _ := newTestServer(t, &Config{Host: "flakbase.test"})
+	defer server.Close()
+
+	// write to namespaces by parameter and subdomain.
+	status, _ := request(t, http.MethodPut, server.URL+"/path.json?ns=ns1", "", `"value1"`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodPut, server.URL+"/path.json", "ns2.flakbase.test", `"value2"`)
+	assert.Equal(t, http.StatusOK, status)
+
+	// each namespace is isolated.
+	_, body := request(t, http.MethodGet, server.URL+"/path.json", "ns1.flakbase.test", "")
+	assert.Equal(t, `"value1"`, body)
+	_, body = request(t, http.MethodGet, server.URL+"/path.json?ns=ns2", "", "")
+	assert.Equal(t, `"value2"`, body)
+	_, body = request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, `null`, body)
+
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json?ns=../ns1", "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestNamespaceHandshake(t *testing.T) {
+	server, _ := newTestServer(t, &Config{Host: "flakbase.test"})
+	defer server.Close()
+
+	testCases := []struct {
+		path string
+		host string
+		h    string
+	}{
+		{"/", "", "flakbase.test"},
+		{"/?ns=ns1", "", "ns1.flakbase.test"},
+		{"/", "ns1.flakbase.test", "ns1.flakbase.test"},
+	}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		if tc.host != "" {
+			header.Set("Host", tc.host)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tc.path, header)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		m := receive(t, conn)
+		assert.Equal(t, tc.h, m["d"].(map[string]interface{})["d"].(map[string]interface{})["h"])
+		conn.Close()
+	}
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	server, _ := newTestServer(t, &Config{Host: "flakbase.test", Namespaces: []string{"ns1", "ns2", "ns3"}, MaxNamespaces: 2})
+	defer server.Close()
+
+	// only the allowed namespaces are created.
+	status, _ := request(t, http.MethodGet, server.URL+"/path.json?ns=ns1", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json?ns=ns4", "", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// no more namespace is created beyond the max, including the default one.
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json?ns=ns2", "", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json?ns=ns1", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestRedirectedNamespace(t *testing.T) {
+	server, _ := newTestServer(t, &Config{Host: "flakbase.test", MaxNamespaces: 2, Redirects: map[string]string{"ns1": "other:9527", "ns2": "other:9527"}})
+	defer server.Close()
+
+	// the redirected namespaces are not created.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, ns := range []string{"ns1", "ns2"} {
+		resp, err := client.Get(server.URL + "/path.json?ns=" + ns)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		}
+	}
+	status, _ := request(t, http.MethodGet, server.URL+"/path.json?ns=ns3", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, server.Config.Handler.(*handler).namespaces.h, 2)
+}
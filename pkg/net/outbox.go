@@ -0,0 +1,173 @@
+package net
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+const (
+	// SlowConsumerCoalesce replaces the pending listen message of the same path and
+	// query with the newer one when the outbound queue is full.
+	SlowConsumerCoalesce = "coalesce"
+	// SlowConsumerDisconnect closes the connection when the outbound queue is full.
+	SlowConsumerDisconnect = "disconnect"
+)
+
+// errQueueFull implies the client falls too far behind to receive messages.
+var errQueueFull = errors.New("outbound queue full")
+
+// errOutboxClosed implies the connection is closing.
+var errOutboxClosed = errors.New("outbox closed")
+
+// listenKey identifies the listen messages which can be coalesced.
+type listenKey struct {
+	ref     string
+	queryID int64
+}
+
+// outbox defines the bounded outbound queue of a connection, so that pushing a message
+// never blocks on a slow client.
+type outbox struct {
+	sync.Mutex
+	size    int
+	policy  string
+	queue   *list.List
+	listens map[listenKey]*list.Element
+	notify  chan struct{}
+	closed  bool
+}
+
+// newOutbox creates an outbox holding at most size messages, unbounded if size is 0.
+func newOutbox(size int, policy string) *outbox {
+	return &outbox{
+		size:    size,
+		policy:  policy,
+		queue:   list.New(),
+		listens: map[listenKey]*list.Element{},
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a message, returns errQueueFull if the queue is full and the listen
+// message can not be coalesced.
+func (o *outbox) push(m data.Message) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return errOutboxClosed
+	}
+
+	// only a listen message can be coalesced with the pending one of same reference,
+	// which is replaced in place to keep the order with the other messages. the other
+	// messages are bounded by the client requests so they are still queued.
+	msg, isListen := m.(data.ListenMessage)
+	key := listenKey{ref: msg.Ref, queryID: msg.QueryID}
+	if o.size > 0 && o.queue.Len() >= o.size {
+		switch e, ok := o.listens[key]; {
+		case o.policy != SlowConsumerCoalesce:
+			return errQueueFull
+		case isListen && ok:
+			e.Value = coalesce(e.Value.(data.ListenMessage), msg)
+			metrics.Add(metricQueueCoalesced, 1)
+			return nil
+		case isListen:
+			return errQueueFull
+		}
+	}
+
+	e := o.queue.PushBack(m)
+	if isListen {
+		o.listens[key] = e
+	}
+	metrics.Add(metricQueueDepth, 1)
+
+	// wake up the pending pop.
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop blocks until a message is queued, returns false if the outbox is closed and drained.
+func (o *outbox) pop() (data.Message, bool) {
+	for {
+		o.Lock()
+		if m, ok := o.front(); ok {
+			o.Unlock()
+			return m, true
+		}
+		closed := o.closed
+		o.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		<-o.notify
+	}
+}
+
+// tryPop returns a queued message without blocking, false if the queue is empty.
+func (o *outbox) tryPop() (data.Message, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.front()
+}
+
+// front removes and returns the first message, should be called with lock.
+func (o *outbox) front() (data.Message, bool) {
+	e := o.queue.Front()
+	if e == nil {
+		return nil, false
+	}
+	o.queue.Remove(e)
+	if msg, ok := e.Value.(data.ListenMessage); ok {
+		if key := (listenKey{ref: msg.Ref, queryID: msg.QueryID}); o.listens[key] == e {
+			delete(o.listens, key)
+		}
+	}
+	metrics.Add(metricQueueDepth, -1)
+	return e.Value.(data.Message), true
+}
+
+// close rejects the further messages, the queued messages can still be popped.
+func (o *outbox) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	o.closed = true
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce combines a pending listen message with the newer one of same reference.
+func coalesce(pending, msg data.ListenMessage) data.ListenMessage {
+	// the newer message replaces the whole data.
+	if !msg.Merge {
+		return msg
+	}
+
+	// apply the changed children on a copy of the pending data.
+	merged := map[string]interface{}{}
+	if m, ok := pending.Data.(map[string]interface{}); ok {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	for k, v := range msg.Data.(map[string]interface{}) {
+		if v == nil && !pending.Merge {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	pending.Data = merged
+	return pending
+}
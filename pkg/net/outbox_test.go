@@ -0,0 +1,77 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxCoalesce(t *testing.T) {
+	depth, coalesced := metric(metricQueueDepth), metric(metricQueueCoalesced)
+	out := newOutbox(2, SlowConsumerCoalesce)
+
+	assert.NoError(t, out.push(data.ListenMessage{Ref: "/a", Data: 1}))
+	assert.NoError(t, out.push(data.OkMessage{RequestID: 1}))
+	assert.Equal(t, depth+2, metric(metricQueueDepth))
+
+	// the pending listen message of the same path is replaced by the newer one.
+	assert.NoError(t, out.push(data.ListenMessage{Ref: "/a", Data: 2}))
+	assert.Equal(t, coalesced+1, metric(metricQueueCoalesced))
+	assert.Equal(t, depth+2, metric(metricQueueDepth))
+
+	// a listen message without pending one to replace overflows the queue, while the
+	// other messages are still queued.
+	assert.Equal(t, errQueueFull, out.push(data.ListenMessage{Ref: "/b", Data: 1}))
+	assert.NoError(t, out.push(data.OkMessage{RequestID: 2}))
+	assert.Equal(t, depth+3, metric(metricQueueDepth))
+
+	// the messages are popped in order, and drained after closed.
+	out.close()
+	assert.Equal(t, errOutboxClosed, out.push(data.OkMessage{RequestID: 3}))
+	for _, expected := range []data.Message{
+		data.ListenMessage{Ref: "/a", Data: 2},
+		data.OkMessage{RequestID: 1},
+		data.OkMessage{RequestID: 2},
+	} {
+		m, ok := out.pop()
+		assert.True(t, ok)
+		assert.Equal(t, expected, m)
+	}
+	_, ok := out.pop()
+	assert.False(t, ok)
+	assert.Equal(t, depth, metric(metricQueueDepth))
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+	out := newOutbox(1, SlowConsumerDisconnect)
+
+	assert.NoError(t, out.push(data.ListenMessage{Ref: "/a", Data: 1}))
+	assert.Equal(t, errQueueFull, out.push(data.ListenMessage{Ref: "/a", Data: 2}))
+
+	// pop blocks until a message is pushed.
+	m, ok := out.pop()
+	assert.True(t, ok)
+	assert.Equal(t, data.ListenMessage{Ref: "/a", Data: 1}, m)
+	popped := make(chan data.Message)
+	go func() {
+		m, _ := out.pop()
+		popped <- m
+	}()
+	assert.NoError(t, out.push(data.OkMessage{RequestID: 1}))
+	assert.Equal(t, data.OkMessage{RequestID: 1}, <-popped)
+}
+
+func TestCoalesceMerge(t *testing.T) {
+	put := data.ListenMessage{Ref: "/a", Data: map[string]interface{}{"k1": 1, "k2": 2}}
+	merge := data.ListenMessage{Ref: "/a", Data: map[string]interface{}{"k2": nil, "k3": 3}, Merge: true}
+
+	// a merge is applied on the pending data.
+	assert.Equal(t, data.ListenMessage{Ref: "/a", Data: map[string]interface{}{"k1": 1, "k3": 3}}, coalesce(put, merge))
+	assert.Equal(t, data.ListenMessage{Ref: "/a", Data: map[string]interface{}{"k1": 1, "k2": nil, "k3": 3}, Merge: true},
+		coalesce(data.ListenMessage{Ref: "/a", Data: map[string]interface{}{"k1": 1}, Merge: true}, merge))
+	assert.Equal(t, map[string]interface{}{"k1": 1, "k2": 2}, put.Data)
+
+	// a put replaces the pending data.
+	assert.Equal(t, put, coalesce(merge, put))
+}
@@ -0,0 +1,65 @@
+package net
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// pushChars defines the characters of push id in ascending order of ASCII.
+const pushChars = "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+
+// pushIDs generates the Firebase push ids, which are 8 characters of timestamp in
+// milliseconds followed by 12 random characters. The random part is incremented for
+// ids generated in the same millisecond, so the ids are sorted chronologically.
+type pushIDs struct {
+	sync.Mutex
+	// rand defines the random source of generator, seeded on first use.
+	rand     *rand.Rand
+	lastTime int64
+	lastRand [12]int
+}
+
+func (p *pushIDs) next() string {
+	return p.generate(time.Now())
+}
+
+func (p *pushIDs) generate(now time.Time) string {
+	p.Lock()
+	defer p.Unlock()
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if ms <= p.lastTime {
+		// increment the random part, keep the last time to stay monotonic even if
+		// clock goes backward.
+		ms = p.lastTime
+		i := len(p.lastRand) - 1
+		for ; i >= 0 && p.lastRand[i] == len(pushChars)-1; i-- {
+			p.lastRand[i] = 0
+		}
+		if i >= 0 {
+			p.lastRand[i]++
+		} else {
+			// the random part overflows, move to next millisecond.
+			ms++
+		}
+	} else {
+		if p.rand == nil {
+			p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		for i := range p.lastRand {
+			p.lastRand[i] = p.rand.Intn(len(pushChars))
+		}
+	}
+	p.lastTime = ms
+
+	id := make([]byte, 20)
+	for i := 7; i >= 0; i-- {
+		id[i] = pushChars[ms%int64(len(pushChars))]
+		ms /= int64(len(pushChars))
+	}
+	for i, r := range p.lastRand {
+		id[8+i] = pushChars[r]
+	}
+	return string(id)
+}
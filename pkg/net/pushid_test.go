@@ -0,0 +1,77 @@
+package net
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushIDs(t *testing.T) {
+	p := &pushIDs{}
+	now := time.Unix(1500000000, 0)
+
+	// the ids of same millisecond are increasing.
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = p.generate(now)
+		assert.Len(t, ids[i], 20)
+	}
+	assert.True(t, sort.StringsAreSorted(ids))
+	for i := 1; i < len(ids); i++ {
+		assert.NotEqual(t, ids[i-1], ids[i])
+	}
+
+	// the timestamp part is shared in the same millisecond and sortable across time.
+	assert.Equal(t, "-KoyxtV-", ids[0][:8])
+	assert.True(t, strings.HasPrefix(ids[len(ids)-1], "-KoyxtV-"))
+	later := p.generate(now.Add(time.Millisecond))
+	assert.True(t, later > ids[len(ids)-1])
+
+	// ids stay increasing if clock goes backward.
+	assert.True(t, p.generate(now) > later)
+}
+
+func TestPushIDOverflow(t *testing.T) {
+	p := &pushIDs{}
+	now := time.Unix(1500000000, 0)
+	first := p.generate(now)
+	for i := range p.lastRand {
+		p.lastRand[i] = len(pushChars) - 1
+	}
+	next := p.generate(now)
+	assert.True(t, next > first)
+	assert.Equal(t, "-KoyxtV0", next[:8])
+}
+
+func TestConcurrentPushIDs(t *testing.T) {
+	p := &pushIDs{}
+	now := time.Unix(1500000000, 0)
+
+	// the ids of same millisecond are distinct and increasing across goroutines.
+	var wg sync.WaitGroup
+	ids := make([][]string, 10)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ids[i] = append(ids[i], p.generate(now))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, ids := range ids {
+		assert.True(t, sort.StringsAreSorted(ids))
+		for _, id := range ids {
+			assert.False(t, seen[id], id)
+			seen[id] = true
+		}
+	}
+	assert.Len(t, seen, 1000)
+}
@@ -0,0 +1,93 @@
+package net
+
+import (
+	"log"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+// redirects defines the namespaces redirected to other hosts, and the live connections
+// of each namespace to be moved when a redirect is set.
+type redirects struct {
+	sync.Mutex
+	hosts map[string]string
+	conns map[string]map[transport]func(host string)
+}
+
+// track registers a connection with the function to redirect it, returns the host
+// instead if the namespace is already redirected.
+func (r *redirects) track(ns string, t transport, redirect func(host string)) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if host, ok := r.hosts[ns]; ok {
+		return host
+	}
+	if r.conns == nil {
+		r.conns = map[string]map[transport]func(string){}
+	}
+	if _, ok := r.conns[ns]; !ok {
+		r.conns[ns] = map[transport]func(string){}
+	}
+	r.conns[ns][t] = redirect
+	return ""
+}
+
+func (r *redirects) untrack(ns string, t transport) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.conns[ns], t)
+}
+
+// host returns the host the namespace redirected to, empty if not redirected.
+func (r *redirects) host(ns string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.hosts[ns]
+}
+
+// list returns a copy of the redirected namespaces and hosts.
+func (r *redirects) list() map[string]string {
+	r.Lock()
+	defer r.Unlock()
+
+	hosts := map[string]string{}
+	for ns, host := range r.hosts {
+		hosts[ns] = host
+	}
+	return hosts
+}
+
+// set redirects the namespace to host, the live connections are redirected as well.
+func (r *redirects) set(ns, host string) {
+	r.Lock()
+	if r.hosts == nil {
+		r.hosts = map[string]string{}
+	}
+	r.hosts[ns] = host
+	conns := r.conns[ns]
+	delete(r.conns, ns)
+	r.Unlock()
+
+	for _, redirect := range conns {
+		go redirect(host)
+	}
+}
+
+func (r *redirects) remove(ns string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.hosts, ns)
+}
+
+// redirect sends the redirect message and closes the transport.
+func redirect(t transport, send func(data.Message) error, host string) {
+	if err := send(data.RedirectMessage{Host: host}); err != nil {
+		log.Printf("failed to send redirect message to %s: %v", t, err)
+	}
+	t.close()
+}
@@ -3,8 +3,12 @@ package net
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 )
@@ -16,8 +20,10 @@ func ParseQuery(q url.Values) (*data.Query, error) {
 	limitToLast := q.Get("limitToLast")
 	orderBy := q.Get("orderBy")
 	startAt := q.Get("startAt")
+	startAfter := q.Get("startAfter")
 	startKey := q.Get("startKey")
 	endAt := q.Get("endAt")
+	endBefore := q.Get("endBefore")
 	endKey := q.Get("endKey")
 	equalTo := q.Get("equalTo")
 	shallow := q.Get("shallow")
@@ -59,14 +65,32 @@ func ParseQuery(q url.Values) (*data.Query, error) {
 		}
 		startAt, endAt = equalTo, equalTo
 	}
+
+	// startAfter and endBefore are the exclusive startAt and endAt.
+	if startAfter != "" {
+		if startAt != "" {
+			return nil, fmt.Errorf("startAfter %s cannot be with startAt %s or equalTo", startAfter, startAt)
+		}
+		startAt, query.StartAfter = startAfter, true
+	}
+	if endBefore != "" {
+		if endAt != "" {
+			return nil, fmt.Errorf("endBefore %s cannot be with endAt %s or equalTo", endBefore, endAt)
+		}
+		endAt, query.EndBefore = endBefore, true
+	}
 	if startAt != "" {
 		if err := json.Unmarshal([]byte(startAt), &query.StartAt); err != nil {
 			query.StartAt = startAt
+		} else if !data.IsBound(query.StartAt) {
+			return nil, fmt.Errorf("invalid startAt %s", startAt)
 		}
 	}
 	if endAt != "" {
 		if err := json.Unmarshal([]byte(endAt), &query.EndAt); err != nil {
 			query.EndAt = endAt
+		} else if !data.IsBound(query.EndAt) {
+			return nil, fmt.Errorf("invalid endAt %s", endAt)
 		}
 	}
 
@@ -75,3 +99,164 @@ func ParseQuery(q url.Values) (*data.Query, error) {
 
 	return query, nil
 }
+
+// Output defines the output format of a restful response.
+type Output struct {
+	// Pretty indents the JSON response.
+	Pretty bool
+	// Silent responds no content for writes.
+	Silent bool
+	// Export includes the priorities in response.
+	Export bool
+	// Download defines the file name to save the response as.
+	Download string
+}
+
+// ParseOutput parses query string into restful Output.
+func ParseOutput(q url.Values) (*Output, error) {
+	output := &Output{Download: q.Get("download")}
+
+	switch print := q.Get("print"); print {
+	case "":
+	case "pretty":
+		output.Pretty = true
+	case "silent":
+		output.Silent = true
+	default:
+		return nil, fmt.Errorf("invalid print %s", print)
+	}
+
+	switch format := q.Get("format"); format {
+	case "":
+	case "export":
+		output.Export = true
+	default:
+		return nil, fmt.Errorf("invalid format %s", format)
+	}
+
+	return output, nil
+}
+
+// maxTimeout defines the max timeout of a restful request.
+const maxTimeout = 15 * time.Minute
+
+// writeSizeLimits defines the max size of a write in bytes by writeSizeLimit, which
+// approximates the targeted durations of 1s, 10s, 30s and 60s, 0 for unlimited.
+var writeSizeLimits = map[string]int64{
+	"tiny":      1 << 20,
+	"small":     10 << 20,
+	"medium":    30 << 20,
+	"large":     60 << 20,
+	"unlimited": 0,
+}
+
+// Limits defines the limits of a restful request.
+type Limits struct {
+	// Timeout defines the duration to give up the request, 0 for no timeout.
+	Timeout time.Duration
+	// WriteSize defines the max size of a write in bytes, 0 for unlimited.
+	WriteSize int64
+}
+
+// ParseLimits parses query string into restful Limits.
+func ParseLimits(q url.Values) (*Limits, error) {
+	limits := &Limits{}
+
+	// the timeout is in ms, s or min, such as 3s, while go duration uses m for min.
+	if timeout := q.Get("timeout"); timeout != "" {
+		d, err := time.ParseDuration(strings.Replace(timeout, "min", "m", 1))
+		if err != nil || d <= 0 || d > maxTimeout {
+			return nil, fmt.Errorf("invalid timeout %s", timeout)
+		}
+		limits.Timeout = d
+	}
+
+	if writeSizeLimit := q.Get("writeSizeLimit"); writeSizeLimit != "" {
+		size, ok := writeSizeLimits[writeSizeLimit]
+		if !ok {
+			return nil, fmt.Errorf("invalid writeSizeLimit %s", writeSizeLimit)
+		}
+		limits.WriteSize = size
+	}
+
+	return limits, nil
+}
+
+// restfulMethod returns the method of request, which can be overridden for POST by
+// X-HTTP-Method-Override header or x-http-method-override query string.
+func restfulMethod(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return r.Method
+	}
+	if method := r.Header.Get("X-HTTP-Method-Override"); method != "" {
+		return strings.ToUpper(method)
+	}
+	if method := r.URL.Query().Get("x-http-method-override"); method != "" {
+		return strings.ToUpper(method)
+	}
+	return r.Method
+}
+
+// nullETag defines the ETag of null data.
+const nullETag = "null_etag"
+
+// etag returns the ETag of data for conditional requests, which is the node hash.
+func etag(v interface{}) string {
+	if hash := data.Hash(v); hash != "" {
+		return hash
+	}
+	return nullETag
+}
+
+// restfulMethods defines the methods allowed by restful api.
+var restfulMethods = []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete}
+
+// errorStatuses maps the error kinds to http status, others are internal errors.
+var errorStatuses = map[data.ErrorKind]int{
+	data.KindInvalid:     http.StatusBadRequest,
+	data.KindPermission:  http.StatusUnauthorized,
+	data.KindNotFound:    http.StatusNotFound,
+	data.KindMethod:      http.StatusMethodNotAllowed,
+	data.KindTooLarge:    http.StatusRequestEntityTooLarge,
+	data.KindUnsupported: http.StatusNotImplemented,
+	data.KindTimeout:     http.StatusRequestTimeout,
+}
+
+// wireStatuses maps the error kinds to the status of websocket responses, others are
+// internal errors.
+var wireStatuses = map[data.ErrorKind]string{
+	data.KindInvalid:     "invalid_data",
+	data.KindPermission:  "permission_denied",
+	data.KindNotFound:    "not_found",
+	data.KindMethod:      "invalid_request",
+	data.KindTooLarge:    "write_too_big",
+	data.KindUnsupported: "not_supported",
+	data.KindTimeout:     "timeout",
+}
+
+// failedMessage reports the error of request with the status of its kind, the details
+// of internal errors are not reported.
+func failedMessage(requestID int64, err error) data.FailedMessage {
+	status, ok := wireStatuses[data.KindOf(err)]
+	if !ok {
+		return data.FailedMessage{RequestID: requestID, Reason: "Internal server error."}
+	}
+	return data.FailedMessage{RequestID: requestID, Status: status, Reason: err.Error()}
+}
+
+// writeError writes the error as {"error": "..."} with the status of its kind,
+// the details of internal errors are logged instead of responded.
+func writeError(w http.ResponseWriter, err error) {
+	message := err.Error()
+	status, ok := errorStatuses[data.KindOf(err)]
+	if !ok {
+		log.Printf("failed to serve restful: %v", err)
+		status, message = http.StatusInternalServerError, "Internal server error."
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		log.Printf("failed to write error: %v", err)
+	}
+}
@@ -1,10 +1,19 @@
 package net
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/IguteChung/flakbase/pkg/store"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,6 +24,11 @@ func TestParseInvalidQuery(t *testing.T) {
 		url.Values{"limitToLast": []string{"A"}},
 		url.Values{"equalTo": []string{"value"}, "startAt": []string{"value2"}},
 		url.Values{"equalTo": []string{"value"}, "endAt": []string{"value2"}},
+		url.Values{"startAfter": []string{"value"}, "startAt": []string{"value2"}},
+		url.Values{"endBefore": []string{"value"}, "equalTo": []string{"value2"}},
+		url.Values{"equalTo": []string{`{"a":1}`}},
+		url.Values{"startAt": []string{`[1]`}},
+		url.Values{"endAt": []string{`{}`}},
 	}
 
 	for _, v := range values {
@@ -72,6 +86,10 @@ func TestParseQuery(t *testing.T) {
 			url.Values{"startKey": []string{"string1"}, "endKey": []string{"string2"}},
 			&data.Query{StartKey: "string1", EndKey: "string2"},
 		},
+		{
+			url.Values{"startAfter": []string{"3"}, "endBefore": []string{`"z"`}, "startKey": []string{"key"}},
+			&data.Query{StartAt: float64(3), StartAfter: true, StartKey: "key", EndAt: "z", EndBefore: true},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -80,3 +98,301 @@ func TestParseQuery(t *testing.T) {
 		assert.EqualValues(t, tc.q, query)
 	}
 }
+
+func TestPush(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// push twice and read the children in order.
+	var names []string
+	for _, body := range []string{`{"text":"first"}`, `{"text":"second"}`} {
+		status, resp := request(t, http.MethodPost, server.URL+"/messages.json", "", body)
+		assert.Equal(t, http.StatusOK, status)
+		var pushed map[string]string
+		assert.NoError(t, json.Unmarshal([]byte(resp), &pushed))
+		assert.Len(t, pushed["name"], 20)
+		names = append(names, pushed["name"])
+	}
+	assert.True(t, names[0] < names[1])
+
+	_, resp := request(t, http.MethodGet, server.URL+"/messages.json", "", "")
+	var messages map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(resp), &messages))
+	assert.Equal(t, map[string]interface{}{
+		names[0]: map[string]interface{}{"text": "first"},
+		names[1]: map[string]interface{}{"text": "second"},
+	}, messages)
+}
+
+func TestConcurrentPush(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// the concurrent pushes get distinct names, none of them is overwritten.
+	var wg sync.WaitGroup
+	names := make([]string, 20)
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, resp := request(t, http.MethodPost, server.URL+"/messages.json", "", fmt.Sprint(i))
+			var pushed map[string]string
+			assert.NoError(t, json.Unmarshal([]byte(resp), &pushed))
+			names[i] = pushed["name"]
+		}(i)
+	}
+	wg.Wait()
+
+	_, resp := request(t, http.MethodGet, server.URL+"/messages.json", "", "")
+	var messages map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(resp), &messages))
+	assert.Len(t, messages, len(names))
+	for i, name := range names {
+		assert.Equal(t, float64(i), messages[name])
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	output, err := ParseOutput(url.Values{"print": []string{"pretty"}, "format": []string{"export"}, "download": []string{"data.json"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Output{Pretty: true, Export: true, Download: "data.json"}, output)
+	output, err = ParseOutput(url.Values{"print": []string{"silent"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Output{Silent: true}, output)
+
+	_, err = ParseOutput(url.Values{"print": []string{"ugly"}})
+	assert.Error(t, err)
+	_, err = ParseOutput(url.Values{"format": []string{"xml"}})
+	assert.Error(t, err)
+}
+
+func TestOutput(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// writes respond the data unless silent.
+	status, body := request(t, http.MethodPut, server.URL+"/path.json", "", `{"key":"value"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"key":"value"}`, body)
+	status, body = request(t, http.MethodPatch, server.URL+"/path.json?print=silent", "", `{"key2":"value2"}`)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Empty(t, body)
+
+	// pretty print.
+	_, body = request(t, http.MethodGet, server.URL+"/path.json?print=pretty", "", "")
+	assert.Equal(t, "{\n  \"key\": \"value\",\n  \"key2\": \"value2\"\n}", body)
+
+	// download as a file.
+	resp, err := http.Get(server.URL + "/path.json?download=path.json&format=export")
+	if err != nil {
+		t.Fatalf("unable to get: %v", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `attachment; filename=path.json`, resp.Header.Get("Content-Disposition"))
+
+	status, _ = request(t, http.MethodGet, server.URL+"/path.json?print=ugly", "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestETag(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	conditional := func(method, url, etag, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unable to new request: %v", err)
+		}
+		if etag != "" {
+			req.Header.Set("if-match", etag)
+		}
+		req.Header.Set("X-Firebase-ETag", "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unable to %s %s: %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unable to read response: %v", err)
+		}
+		return resp, string(b)
+	}
+
+	// the ETag of null data.
+	resp, body := conditional(http.MethodGet, server.URL+"/counter.json", "", "")
+	assert.Equal(t, "null", body)
+	assert.Equal(t, nullETag, resp.Header.Get("ETag"))
+
+	// compare and set the counter.
+	resp, _ = conditional(http.MethodPut, server.URL+"/counter.json", nullETag, "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, data.Hash(float64(1)), etag)
+
+	// a stale ETag is rejected with current data.
+	resp, body = conditional(http.MethodPut, server.URL+"/counter.json", nullETag, "2")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, "1", body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	resp, _ = conditional(http.MethodDelete, server.URL+"/counter.json", nullETag, "")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _ = conditional(http.MethodDelete, server.URL+"/counter.json", etag, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, body = conditional(http.MethodGet, server.URL+"/counter.json", "", "")
+	assert.Equal(t, "null", body)
+}
+
+func TestRestfulError(t *testing.T) {
+	server, _ := newTestServer(t, &Config{MaxBodySize: 16})
+	defer server.Close()
+
+	testCases := []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/path.json?limitToFirst=A", "", http.StatusBadRequest},
+		{http.MethodGet, "/path.json?print=ugly", "", http.StatusBadRequest},
+		{http.MethodGet, "/path.json?ns=Invalid_NS", "", http.StatusBadRequest},
+		{http.MethodGet, "/a$b.json", "", http.StatusBadRequest},
+		{http.MethodPut, "/path.json", `{"a.b":1}`, http.StatusBadRequest},
+		{http.MethodPut, "/path.json", `{invalid`, http.StatusBadRequest},
+		{http.MethodPut, "/.info/connected.json", `true`, http.StatusUnauthorized},
+		{http.MethodGet, "/path", "", http.StatusNotFound},
+		{http.MethodHead, "/path.json", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/path.json", `"this body is too large"`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		status, body := request(t, tc.method, server.URL+tc.url, "", tc.body)
+		assert.Equal(t, tc.status, status, "%s %s", tc.method, tc.url)
+		if tc.method == http.MethodHead {
+			continue
+		}
+		var resp map[string]string
+		assert.NoError(t, json.Unmarshal([]byte(body), &resp))
+		assert.NotEmpty(t, resp["error"])
+	}
+
+	// nothing is written by the rejected requests.
+	_, body := request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, "null", body)
+}
+
+func TestMethodOverride(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/path.json", strings.NewReader(`{"key":"value"}`))
+	assert.NoError(t, err)
+	req.Header.Set("X-HTTP-Method-Override", "PUT")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, _ := request(t, http.MethodPost, server.URL+"/path.json?x-http-method-override=PATCH", "", `{"key2":"value2"}`)
+	assert.Equal(t, http.StatusOK, status)
+	_, body := request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, `{"key":"value","key2":"value2"}`, body)
+
+	status, _ = request(t, http.MethodPost, server.URL+"/path.json?x-http-method-override=DELETE", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	_, body = request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, "null", body)
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(url.Values{"timeout": []string{"3s"}, "writeSizeLimit": []string{"tiny"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Limits{Timeout: 3 * time.Second, WriteSize: 1 << 20}, limits)
+	limits, err = ParseLimits(url.Values{"timeout": []string{"2min"}, "writeSizeLimit": []string{"unlimited"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Limits{Timeout: 2 * time.Minute}, limits)
+
+	for _, v := range []url.Values{
+		url.Values{"timeout": []string{"3"}},
+		url.Values{"timeout": []string{"16min"}},
+		url.Values{"writeSizeLimit": []string{"huge"}},
+	} {
+		_, err := ParseLimits(v)
+		assert.Error(t, err)
+	}
+}
+
+func TestWriteSizeLimit(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	large := `"` + strings.Repeat("a", 1<<20) + `"`
+	status, _ := request(t, http.MethodPut, server.URL+"/path.json?writeSizeLimit=tiny", "", large)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	status, _ = request(t, http.MethodPut, server.URL+"/path.json", "", large)
+	assert.Equal(t, http.StatusOK, status)
+
+	// the overwritten data counts too.
+	status, body := request(t, http.MethodDelete, server.URL+"/path.json?writeSizeLimit=tiny", "", "")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, body, "exceeds the maximum size")
+	status, _ = request(t, http.MethodDelete, server.URL+"/path.json?writeSizeLimit=small", "", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	// an update counts the data overwritten at the patched children only.
+	status, _ = request(t, http.MethodPut, server.URL+"/path.json", "", `{"a":`+large+`,"b":"value"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodPatch, server.URL+"/path.json?writeSizeLimit=tiny", "", `{"b":"value2"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodPatch, server.URL+"/path.json?writeSizeLimit=tiny", "", `{"a":"value"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+// slowHandler defines a datastore whose writes last until the request is cancelled.
+type slowHandler struct {
+	store.Handler
+}
+
+func (h *slowHandler) HandleSet(ctx context.Context, ref string, value interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{})
+	defer server.Close()
+
+	// the write outlasting the timeout is reported.
+	namespaces := server.Config.Handler.(*handler).namespaces
+	namespaces.Lock()
+	namespaces.h[""] = &slowHandler{Handler: datastore}
+	namespaces.Unlock()
+	status, body := request(t, http.MethodPut, server.URL+"/path.json?timeout=10ms", "", `"value"`)
+	assert.Equal(t, http.StatusRequestTimeout, status)
+	assert.Contains(t, body, "request exceeded timeout")
+
+	namespaces.Lock()
+	namespaces.h[""] = datastore
+	namespaces.Unlock()
+	status, _ = request(t, http.MethodPut, server.URL+"/path.json?timeout=3s", "", `"value"`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestPriority(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+
+	status, _ := request(t, http.MethodPut, server.URL+"/path.json", "", `{"a":{".value":1,".priority":2},"b":{"key":"value",".priority":1}}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = request(t, http.MethodPut, server.URL+"/path/c/.priority.json", "", `3`)
+	assert.Equal(t, http.StatusOK, status)
+
+	// the priorities are responded only for export format.
+	_, body := request(t, http.MethodGet, server.URL+"/path.json", "", "")
+	assert.Equal(t, `{"a":1,"b":{"key":"value"}}`, body)
+	_, body = request(t, http.MethodGet, server.URL+"/path.json?format=export", "", "")
+	assert.Equal(t, `{"a":{".priority":2,".value":1},"b":{".priority":1,"key":"value"}}`, body)
+	_, body = request(t, http.MethodGet, server.URL+`/path.json?orderBy="$priority"&limitToFirst=1`, "", "")
+	assert.Equal(t, `{"b":{"key":"value"}}`, body)
+}
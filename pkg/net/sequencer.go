@@ -0,0 +1,64 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+// sequencer orders the requests of a connection. Writes are handled one by one in
+// arrival order, other requests only wait for the preceding writes so they can be
+// handled concurrently, except listen and unlisten of the same query are ordered.
+type sequencer struct {
+	sync.Mutex
+	// written defines the channel closed when the last scheduled write handled.
+	written chan struct{}
+	// listens defines the channels closed when the last listen or unlisten handled.
+	listens map[string]chan struct{}
+}
+
+func newSequencer() *sequencer {
+	written := make(chan struct{})
+	close(written)
+	return &sequencer{
+		written: written,
+		listens: map[string]chan struct{}{},
+	}
+}
+
+// schedule returns a function which blocks until the request can be handled, and a
+// function to call after the request handled. It should be called in arrival order.
+func (s *sequencer) schedule(r *data.Request) (wait func(), done func()) {
+	s.Lock()
+	defer s.Unlock()
+
+	ch := make(chan struct{})
+	waits := []chan struct{}{s.written}
+	done = func() { close(ch) }
+	switch r.Type {
+	case data.TypeSet, data.TypeUpdate, data.TypeDisconnectSet, data.TypeDisconnectUpdate, data.TypeDisconnectCancel:
+		s.written = ch
+	case data.TypeListen, data.TypeUnlisten:
+		key := fmt.Sprintf("%s:%d", r.Ref, r.Query.ID)
+		if prev, ok := s.listens[key]; ok {
+			waits = append(waits, prev)
+		}
+		s.listens[key] = ch
+		done = func() {
+			close(ch)
+			s.Lock()
+			defer s.Unlock()
+			if s.listens[key] == ch {
+				delete(s.listens, key)
+			}
+		}
+	}
+
+	wait = func() {
+		for _, w := range waits {
+			<-w
+		}
+	}
+	return wait, done
+}
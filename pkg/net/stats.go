@@ -0,0 +1,63 @@
+package net
+
+import (
+	"strings"
+	"sync"
+)
+
+// clientStats aggregates the counters reported by client SDKs.
+type clientStats struct {
+	sync.Mutex
+	// sdks defines the counts by platform and version.
+	sdks map[string]map[string]float64
+	// others defines the counters not reporting SDK versions.
+	others map[string]float64
+}
+
+// record aggregates the counters of a stats request, the SDK counters are
+// named as "sdk.<platform>.<version>" with dashes in version.
+func (c *clientStats) record(stats map[string]interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.sdks == nil {
+		c.sdks = map[string]map[string]float64{}
+		c.others = map[string]float64{}
+	}
+	for k, v := range stats {
+		count, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if parts := strings.SplitN(k, ".", 3); len(parts) == 3 && parts[0] == "sdk" {
+			platform, version := parts[1], strings.Replace(parts[2], "-", ".", -1)
+			if _, ok := c.sdks[platform]; !ok {
+				c.sdks[platform] = map[string]float64{}
+			}
+			c.sdks[platform][version] += count
+		} else {
+			c.others[k] += count
+		}
+	}
+}
+
+// snapshot returns a copy of the aggregated counters.
+func (c *clientStats) snapshot() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	sdks, others := map[string]map[string]float64{}, map[string]float64{}
+	for platform, versions := range c.sdks {
+		sdks[platform] = map[string]float64{}
+		for version, count := range versions {
+			sdks[platform][version] = count
+		}
+	}
+	for k, count := range c.others {
+		others[k] = count
+	}
+	return map[string]interface{}{
+		"sdk":    sdks,
+		"others": others,
+	}
+}
@@ -0,0 +1,148 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/IguteChung/flakbase/pkg/store"
+)
+
+// streamKeepAlive defines the interval to send keep-alive events.
+const streamKeepAlive = 30 * time.Second
+
+// streamable checks if the request asks for server-sent events.
+func streamable(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveStream streams the changes of reference as server-sent events, which are put,
+// patch, keep-alive and cancel. auth_revoked is never sent since clients are not
+// authenticated. It returns error only if the stream is not started.
+func (s *handler) serveStream(ctx context.Context, ns *namespace, w http.ResponseWriter, r *http.Request) error {
+	// check url is valid.
+	u := r.URL.Path
+	if !strings.HasSuffix(u, ".json") {
+		return data.Errorf(data.KindNotFound, "invalid path %s, should end with .json", u)
+	}
+	ref := u[:len(u)-len(".json")]
+
+	query, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		return data.Errorf(data.KindInvalid, "invalid query: %v", err)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("response does not implement http.Flusher")
+	}
+
+	// queue the listen messages so that the datastore never blocks on a slow client.
+	out := newOutbox(s.MaxQueueSize, s.SlowConsumer)
+	overflow := make(chan struct{}, 1)
+	ch := make(store.ListenChannel)
+	if err := ns.datastore.HandleConnect(ctx, ch); err != nil {
+		return data.Wrapf(err, "failed to handle connect")
+	}
+	go func() {
+		defer out.close()
+		for msg := range ch {
+			if err := out.push(msg); err == errQueueFull {
+				select {
+				case overflow <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	// listen the reference in background since the messages are sent to channel.
+	var wg sync.WaitGroup
+	cancelled := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := ns.datastore.HandleListen(ctx, ref, *query, ch); err != nil {
+			cancelled <- err
+		}
+	}()
+
+	// unlisten when the client disconnected.
+	defer func() {
+		wg.Wait()
+		if err := ns.datastore.HandleDisconnect(context.Background(), ch); err != nil {
+			log.Printf("failed to handle disconnect %s: %v", r.RemoteAddr, err)
+		}
+		close(ch)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		// flush the queued messages.
+		for m, ok := out.tryPop(); ok; m, ok = out.tryPop() {
+			// strip the priorities like restful responses.
+			msg := m.(data.ListenMessage)
+			event, value := "put", data.StripPriority(msg.Data)
+			if children, ok := msg.Data.(map[string]interface{}); ok && msg.Merge {
+				event, value = "patch", stripChildren(children)
+			}
+			path := "/" + strings.Trim(strings.TrimPrefix(msg.Ref, ref), "/")
+			if err := writeEvent(w, event, map[string]interface{}{"path": path, "data": value}); err != nil {
+				log.Printf("failed to write %s event: %v", event, err)
+				return nil
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-cancelled:
+			log.Printf("failed to listen %s: %v", ref, err)
+			writeEvent(w, "cancel", nil)
+			return nil
+		case <-overflow:
+			metrics.Add(metricSlowConsumers, 1)
+			log.Printf("failed to stream %s: %v", ref, errQueueFull)
+			writeEvent(w, "cancel", nil)
+			return nil
+		case <-keepAlive.C:
+			if err := writeEvent(w, "keep-alive", nil); err != nil {
+				log.Printf("failed to write keep-alive event: %v", err)
+				return nil
+			}
+		case <-out.notify:
+		}
+	}
+}
+
+// stripChildren strips the priorities of merged children, the removed children are kept.
+func stripChildren(children map[string]interface{}) map[string]interface{} {
+	stripped := make(map[string]interface{}, len(children))
+	for k, v := range children {
+		stripped[k] = data.StripPriority(v)
+	}
+	return stripped
+}
+
+// writeEvent writes a server-sent event with JSON data.
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, bytes)
+	return err
+}
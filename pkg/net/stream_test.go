@@ -0,0 +1,95 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stream opens a server-sent events request and returns the function to read events.
+func stream(t *testing.T, url string) (func() (string, map[string]interface{}), context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("unable to new request: %v", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("unable to stream %s: %v", url, err)
+	}
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	read := func() (string, map[string]interface{}) {
+		var event, payload string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unable to read event: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				payload = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		var d map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &d); err != nil {
+			t.Fatalf("unable to unmarshal event data %s: %v", payload, err)
+		}
+		return event, d
+	}
+	return read, func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func TestStream(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+	request(t, http.MethodPut, server.URL+"/path.json", "", `{"a":1}`)
+
+	read, cancel := stream(t, server.URL+"/path.json")
+	event, d := read()
+	assert.Equal(t, "put", event)
+	assert.Equal(t, map[string]interface{}{"path": "/", "data": map[string]interface{}{"a": float64(1)}}, d)
+
+	request(t, http.MethodPut, server.URL+"/path/b.json", "", `2`)
+	event, d = read()
+	assert.Equal(t, "put", event)
+	assert.Equal(t, map[string]interface{}{"path": "/", "data": map[string]interface{}{"a": float64(1), "b": float64(2)}}, d)
+
+	// the writes are not blocked after the stream closed.
+	cancel()
+	status, _ := request(t, http.MethodPut, server.URL+"/path/c.json", "", `3`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestStreamQuery(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+	request(t, http.MethodPut, server.URL+"/list.json", "", `{"a":1,"b":2}`)
+
+	read, cancel := stream(t, server.URL+`/list.json?orderBy="$key"&limitToLast=2`)
+	defer cancel()
+	event, d := read()
+	assert.Equal(t, "put", event)
+	assert.Equal(t, map[string]interface{}{"path": "/", "data": map[string]interface{}{"a": float64(1), "b": float64(2)}}, d)
+
+	// the changes of window are patched.
+	request(t, http.MethodPut, server.URL+"/list/c.json", "", `3`)
+	event, d = read()
+	assert.Equal(t, "patch", event)
+	assert.Equal(t, map[string]interface{}{"path": "/", "data": map[string]interface{}{"a": nil, "c": float64(3)}}, d)
+}
@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 	"github.com/gorilla/websocket"
@@ -28,6 +32,99 @@ func upgradable(header http.Header) bool {
 	return false
 }
 
+// writeTimeout defines the max duration to write a message to a websocket connection.
+const writeTimeout = 10 * time.Second
+
+// websocketTransport defines the transport over a websocket connection.
+type websocketTransport struct {
+	conn               *websocket.Conn
+	maxFrameSize       int
+	idleTimeout        time.Duration
+	compressionMinSize int
+	done               chan struct{}
+	closeOnce          sync.Once
+}
+
+// newWebsocketTransport creates a transport which pings the client periodically, the
+// connection is treated as dead if nothing received within the idle timeout.
+func newWebsocketTransport(conn *websocket.Conn, config *Config) *websocketTransport {
+	idleTimeout := config.IdleTimeout
+	t := &websocketTransport{
+		conn:               conn,
+		maxFrameSize:       config.MaxFrameSize,
+		idleTimeout:        idleTimeout,
+		compressionMinSize: config.CompressionMinSize,
+		done:               make(chan struct{}),
+	}
+
+	// the level takes effect only if compression negotiated.
+	if config.Compression {
+		if err := conn.SetCompressionLevel(config.CompressionLevel); err != nil {
+			log.Printf("failed to set compression level %d: %v", config.CompressionLevel, err)
+		}
+	}
+
+	// extend the read deadline whenever pong received.
+	if idleTimeout > 0 {
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		})
+		go t.ping()
+	}
+	return t
+}
+
+func (t *websocketTransport) read() (*data.Request, error) {
+	if t.idleTimeout > 0 {
+		if err := t.conn.SetReadDeadline(time.Now().Add(t.idleTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline: %v", err)
+		}
+	}
+	return readMessage(t.conn)
+}
+
+func (t *websocketTransport) write(m data.Message) error {
+	if err := t.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %v", err)
+	}
+	return writeMessage(m, t.maxFrameSize, t.writeFrame)
+}
+
+// writeFrame writes a text frame, which is compressed only if large enough.
+func (t *websocketTransport) writeFrame(b []byte) error {
+	t.conn.EnableWriteCompression(len(b) >= t.compressionMinSize)
+	metrics.Add(metricWebsocketBytes, int64(len(b)))
+	return t.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// ping sends ping messages at half of the idle timeout until the transport closed.
+func (t *websocketTransport) ping() {
+	ticker := time.NewTicker(t.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				log.Printf("failed to ping %s: %v", t, err)
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *websocketTransport) close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+func (t *websocketTransport) String() string {
+	return t.conn.RemoteAddr().String()
+}
+
 // readMessage reads a request from connection, automatically concats the splitted
 // chunks if the request payload too large.
 func readMessage(conn *websocket.Conn) (*data.Request, error) {
@@ -43,20 +140,10 @@ func readMessage(conn *websocket.Conn) (*data.Request, error) {
 		return nil, fmt.Errorf("failed to unmarshal message %s: %v", string(bytes), err)
 	}
 
-	// finally return a request model by bytes.
-	toReq := func(bytes []byte) (*data.Request, error) {
-		var r *data.Request
-		if err := json.Unmarshal(bytes, &r); err != nil {
-			log.Printf("failed to unmarshal to request: %v", err)
-			return nil, nil
-		}
-		return r, nil
-	}
-
 	switch v := o.(type) {
 	case map[string]interface{}:
 		// if the message is a json map, directly return.
-		return toReq(bytes)
+		return unmarshalRequest(bytes), nil
 	case float64:
 		if v == 0 {
 			return nil, nil
@@ -73,8 +160,57 @@ func readMessage(conn *websocket.Conn) (*data.Request, error) {
 		}
 
 		// unmarshal the collected buffer.
-		return toReq(buffer)
+		return unmarshalRequest(buffer), nil
 	default:
 		return nil, fmt.Errorf("invalid message: %v", o)
 	}
 }
+
+// unmarshalRequest returns a request model by bytes, nil if not a valid request.
+func unmarshalRequest(bytes []byte) *data.Request {
+	var r *data.Request
+	if err := json.Unmarshal(bytes, &r); err != nil {
+		log.Printf("failed to unmarshal to request: %v", err)
+		return nil
+	}
+	return r
+}
+
+// writeMessage writes a message by writeFrame, automatically splits the payload
+// into a count frame followed by chunks if it exceeds the max frame size.
+func writeMessage(m data.Message, maxFrameSize int, writeFrame func([]byte) error) error {
+	bytes, err := json.Marshal(m.Format())
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	// directly write the message if small enough.
+	if maxFrameSize <= 0 || len(bytes) <= maxFrameSize {
+		return writeFrame(bytes)
+	}
+
+	// split the payload into chunks without breaking utf8 characters.
+	var chunks [][]byte
+	for len(bytes) > maxFrameSize {
+		n := maxFrameSize
+		for n > 0 && !utf8.RuneStart(bytes[n]) {
+			n--
+		}
+		if n == 0 {
+			n = maxFrameSize
+		}
+		chunks, bytes = append(chunks, bytes[:n]), bytes[n:]
+	}
+	chunks = append(chunks, bytes)
+
+	// send the count of chunks first, then the chunks sequentially.
+	if err := writeFrame([]byte(strconv.Itoa(len(chunks)))); err != nil {
+		return fmt.Errorf("failed to write chunk count: %v", err)
+	}
+	for _, chunk := range chunks {
+		if err := writeFrame(chunk); err != nil {
+			return fmt.Errorf("failed to write chunk: %v", err)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,20 @@
 package net
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/IguteChung/flakbase/pkg/store"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,3 +36,339 @@ func TestUpgradable(t *testing.T) {
 		"Upgrade": []string{"websocket"},
 	}))
 }
+
+func newTestServer(t *testing.T, config *Config) (*httptest.Server, store.Handler) {
+	h, err := NewHandler(config)
+	if err != nil {
+		t.Fatalf("unable to new handler: %v", err)
+	}
+	datastore, err := h.(*handler).namespaces.datastore("")
+	if err != nil {
+		t.Fatalf("unable to get memory handler: %v", err)
+	}
+	return httptest.NewServer(h), datastore
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	return dialWith(t, server, websocket.DefaultDialer)
+}
+
+func dialWith(t *testing.T, server *httptest.Server, dialer *websocket.Dialer) *websocket.Conn {
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unable to dial %s: %v", server.URL, err)
+	}
+
+	// skip the initial message.
+	receive(t, conn)
+	return conn
+}
+
+// receive reads a message sent by server, concats the chunks if splitted.
+func receive(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("unable to read message: %v", err)
+	}
+	if count, err := strconv.Atoi(string(b)); err == nil {
+		b = nil
+		for i := 0; i < count; i++ {
+			_, chunk, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("unable to read chunk: %v", err)
+			}
+			b = append(b, chunk...)
+		}
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unable to unmarshal message %s: %v", string(b), err)
+	}
+	return m
+}
+
+func TestWriteSplittedMessage(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{MaxFrameSize: 64})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// prepare a payload much larger than a frame.
+	value := strings.Repeat("流動的資料", 40)
+	assert.NoError(t, datastore.HandleSet(context.Background(), "/path", value))
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"g","b":{"p":"/path"}}}`)))
+
+	// read the count frame.
+	_, b, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	count, err := strconv.Atoi(string(b))
+	assert.NoError(t, err)
+	assert.True(t, count > 1)
+
+	// read and concat all chunks.
+	var buffer []byte
+	for i := 0; i < count; i++ {
+		_, b, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.True(t, len(b) <= 64)
+		assert.True(t, utf8.Valid(b))
+		buffer = append(buffer, b...)
+	}
+
+	var m map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buffer, &m))
+	assert.EqualValues(t, map[string]interface{}{
+		"t": "d",
+		"d": map[string]interface{}{
+			"r": float64(1),
+			"b": map[string]interface{}{"s": "ok", "d": value},
+		},
+	}, m)
+}
+
+func TestWriteSmallMessage(t *testing.T) {
+	server, _ := newTestServer(t, &Config{MaxFrameSize: 64})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"c","d":{"t":"p","d":{}}}`)))
+	_, b, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"t":"c","d":{"t":"o","d":null}}`, string(b))
+	assert.True(t, len(b) <= 64)
+}
+
+// waitValue waits until the value at ref equals the expected one.
+func waitValue(t *testing.T, datastore store.Handler, ref string, expected interface{}, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		v, err := datastore.HandleGet(context.Background(), ref, data.Query{}, nil)
+		assert.NoError(t, err)
+		if assert.ObjectsAreEqual(expected, v) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{IdleTimeout: 200 * time.Millisecond})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// queue an onDisconnect write, then stop reading so no pong is replied.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"o","b":{"p":"/presence","d":"offline"}}}`)))
+	receive(t, conn)
+	assert.True(t, waitValue(t, datastore, "/presence", "offline", 2*time.Second))
+}
+
+func TestHeartbeat(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{IdleTimeout: 200 * time.Millisecond})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"o","b":{"p":"/presence","d":"offline"}}}`)))
+	receive(t, conn)
+
+	// keep reading to reply pongs, the connection should stay alive.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	assert.False(t, waitValue(t, datastore, "/presence", "offline", time.Second))
+
+	// closing the connection applies the onDisconnect write.
+	conn.Close()
+	assert.True(t, waitValue(t, datastore, "/presence", "offline", time.Second))
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{})
+	defer server.Close()
+	conn := dial(t, server)
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"om","b":{"p":"/users/id1","d":{"online":false}}}}`)))
+	receive(t, conn)
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":2,"a":"o","b":{"p":"/users/id2/online","d":false}}}`)))
+	receive(t, conn)
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":3,"a":"oc","b":{"p":"/users/id2","d":null}}}`)))
+	receive(t, conn)
+	conn.Close()
+
+	assert.True(t, waitValue(t, datastore, "/users", map[string]interface{}{
+		"id1": map[string]interface{}{"online": false},
+	}, time.Second))
+}
+
+func metric(key string) int64 {
+	if v, ok := metrics.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCompression(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{
+		Compression:        true,
+		CompressionLevel:   DefaultCompressionLevel,
+		CompressionMinSize: 256,
+	})
+	defer server.Close()
+	conn := dialWith(t, server, &websocket.Dialer{EnableCompression: true})
+	defer conn.Close()
+
+	// a highly compressible payload should be much smaller on wire.
+	value := strings.Repeat("compressible ", 1000)
+	assert.NoError(t, datastore.HandleSet(context.Background(), "/path", value))
+	bytes, wireBytes := metric(metricWebsocketBytes), metric(metricWebsocketWireBytes)
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"g","b":{"p":"/path"}}}`)))
+	m := receive(t, conn)
+	assert.Equal(t, value, m["d"].(map[string]interface{})["b"].(map[string]interface{})["d"])
+
+	sent, wireSent := metric(metricWebsocketBytes)-bytes, metric(metricWebsocketWireBytes)-wireBytes
+	assert.True(t, sent > int64(len(value)))
+	assert.True(t, wireSent < sent/10, "%d bytes compressed to %d", sent, wireSent)
+}
+
+func TestOrderedWrites(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// rapid successive writes should be applied and acknowledged in order.
+	const count = 100
+	for i := 1; i <= count; i++ {
+		msg := `{"t":"d","d":{"r":` + strconv.Itoa(i) + `,"a":"p","b":{"p":"/counter","d":` + strconv.Itoa(i) + `}}}`
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(msg)))
+	}
+	for i := 1; i <= count; i++ {
+		m := receive(t, conn)
+		assert.Equal(t, float64(i), m["d"].(map[string]interface{})["r"])
+	}
+	v, err := datastore.HandleGet(context.Background(), "/counter", data.Query{}, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, count, v)
+
+	// a get should observe the preceding writes.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":101,"a":"p","b":{"p":"/counter","d":"last"}}}`)))
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":102,"a":"g","b":{"p":"/counter"}}}`)))
+	receive(t, conn)
+	m := receive(t, conn)
+	assert.Equal(t, "last", m["d"].(map[string]interface{})["b"].(map[string]interface{})["d"])
+}
+
+func TestTransaction(t *testing.T) {
+	server, _ := newTestServer(t, &Config{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// the transaction on null data succeeds with empty hash.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"p","b":{"p":"/counter","d":1,"h":""}}}`)))
+	m := receive(t, conn)
+	assert.Equal(t, "ok", m["d"].(map[string]interface{})["b"].(map[string]interface{})["s"])
+
+	// a stale hash is rejected.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":2,"a":"p","b":{"p":"/counter","d":2,"h":""}}}`)))
+	m = receive(t, conn)
+	assert.Equal(t, float64(2), m["d"].(map[string]interface{})["r"])
+	assert.Equal(t, "datastale", m["d"].(map[string]interface{})["b"].(map[string]interface{})["s"])
+
+	msg := `{"t":"d","d":{"r":3,"a":"p","b":{"p":"/counter","d":2,"h":"` + data.Hash(float64(1)) + `"}}}`
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(msg)))
+	m = receive(t, conn)
+	assert.Equal(t, "ok", m["d"].(map[string]interface{})["b"].(map[string]interface{})["s"])
+}
+
+func TestGet(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.NoError(t, datastore.HandleSet(context.Background(), "/path", "value"))
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"g","b":{"p":"/path"}}}`)))
+	assert.Equal(t, map[string]interface{}{
+		"t": "d",
+		"d": map[string]interface{}{
+			"r": float64(1),
+			"b": map[string]interface{}{"s": "ok", "d": "value"},
+		},
+	}, receive(t, conn))
+
+	// the .info paths are resolved by the connection.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":2,"a":"g","b":{"p":"/.info/connected"}}}`)))
+	assert.Equal(t, map[string]interface{}{
+		"t": "d",
+		"d": map[string]interface{}{
+			"r": float64(2),
+			"b": map[string]interface{}{"s": "ok", "d": true},
+		},
+	}, receive(t, conn))
+
+	// a failed get reports the error instead of null data.
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":3,"a":"g","b":{"p":"/a$b"}}}`)))
+	m := receive(t, conn)
+	assert.Equal(t, float64(3), m["d"].(map[string]interface{})["r"])
+	b := m["d"].(map[string]interface{})["b"].(map[string]interface{})
+	assert.Equal(t, "invalid_data", b["s"])
+	assert.Contains(t, b["d"], "a$b")
+}
+
+func TestFailedWrite(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// the writes failing validation are reported with the status of error kind.
+	for i, tc := range []struct {
+		msg    string
+		status string
+	}{
+		{`{"t":"d","d":{"r":1,"a":"p","b":{"p":"/path","d":{"a$b":1}}}}`, "invalid_data"},
+		{`{"t":"d","d":{"r":2,"a":"m","b":{"p":"/path","d":{"a/b":{"c[d":1}}}}}`, "invalid_data"},
+		{`{"t":"d","d":{"r":3,"a":"p","b":{"p":"/.info/connected","d":true}}}`, "permission_denied"},
+		{`{"t":"d","d":{"r":4,"a":"o","b":{"p":"/a$b","d":1}}}`, "invalid_data"},
+	} {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tc.msg)))
+		m := receive(t, conn)
+		assert.Equal(t, float64(i+1), m["d"].(map[string]interface{})["r"])
+		assert.Equal(t, tc.status, m["d"].(map[string]interface{})["b"].(map[string]interface{})["s"], tc.msg)
+	}
+
+	resp, err := datastore.HandleGet(context.Background(), "/path", data.Query{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	server, datastore := newTestServer(t, &Config{MaxQueueSize: 4, SlowConsumer: SlowConsumerDisconnect})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"t":"d","d":{"r":1,"a":"q","b":{"p":"/path","h":""}}}`)))
+	receive(t, conn)
+	receive(t, conn)
+
+	// stop reading while the large messages pile up, the connection is counted once.
+	slow := metric(metricSlowConsumers)
+	value := strings.Repeat("x", 1<<16)
+	for i := 0; i < 200 && metric(metricSlowConsumers) == slow; i++ {
+		assert.NoError(t, datastore.HandleSet(context.Background(), "/path", value+strconv.Itoa(i)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, datastore.HandleSet(context.Background(), "/path", value+strconv.Itoa(i)))
+	}
+	assert.Equal(t, slow+1, metric(metricSlowConsumers))
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// coalescer collects the changed subscriptions and flushes them once per window, so
+// that a burst of writes re-evaluates each query only once.
+type coalescer struct {
+	sync.Mutex
+	window   time.Duration
+	maxDelay time.Duration
+	pending  map[subscription]bool
+	deadline time.Time
+	timer    *time.Timer
+	// gen defines the generation of timer, which is changed by clean to skip the stale fire.
+	gen int
+
+	// ctx defines the context of flushes derived from the parent, cancelled by clean.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// flushing serializes the flushes to keep the notifications in order.
+	flushing sync.Mutex
+	flush    func(ctx context.Context, subs []subscription)
+}
+
+func newCoalescer(ctx context.Context, window, maxDelay time.Duration, flush func(ctx context.Context, subs []subscription)) *coalescer {
+	// the window is never extended beyond the max delay.
+	if maxDelay < window {
+		maxDelay = window
+	}
+	c := &coalescer{
+		window:   window,
+		maxDelay: maxDelay,
+		pending:  map[subscription]bool{},
+		parent:   ctx,
+		flush:    flush,
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	return c
+}
+
+// add marks the subscriptions changed, the flush is postponed by every change within
+// the window but no later than the max delay since the first change.
+func (c *coalescer) add(subs ...subscription) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, sub := range subs {
+		c.pending[sub] = true
+	}
+
+	now := time.Now()
+	if c.timer == nil {
+		c.deadline = now.Add(c.maxDelay)
+		gen := c.gen
+		c.timer = time.AfterFunc(c.window, func() { c.fire(gen) })
+		return
+	}
+	delay := c.window
+	if remaining := c.deadline.Sub(now); remaining < delay {
+		delay = remaining
+	}
+	c.timer.Reset(delay)
+}
+
+// fire flushes the pending subscriptions of the timer generation.
+func (c *coalescer) fire(gen int) {
+	c.flushing.Lock()
+	defer c.flushing.Unlock()
+
+	c.Lock()
+	if gen != c.gen {
+		// cleaned after the timer expired.
+		c.Unlock()
+		return
+	}
+	pending, ctx := c.pending, c.ctx
+	c.pending = map[subscription]bool{}
+	c.timer = nil
+	c.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	subs := make([]subscription, 0, len(pending))
+	for sub := range pending {
+		subs = append(subs, sub)
+	}
+	c.flush(ctx, subs)
+}
+
+// clean drops the pending subscriptions, stops the timer and cancels the running flush.
+func (c *coalescer) clean() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.pending = map[subscription]bool{}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.gen++
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(c.parent)
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceWrites(t *testing.T) {
+	ctx := context.Background()
+	handler, err := NewHandler(&Config{CoalesceWindow: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unable to new memory handler: %v", err)
+	}
+	c := newMockListenChannel(t)
+	_, err = handler.HandleListen(ctx, "/path", data.Query{}, c.ch)
+	assert.NoError(t, err)
+	c.assertOccurs(data.ListenMessage{Ref: "/path"})
+
+	// a burst of writes is notified once with the latest data.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, handler.HandleSet(ctx, "/path/counter", float64(i)))
+	}
+	c.assertNotOccurs()
+	time.Sleep(100 * time.Millisecond)
+	c.assertOccurs(data.ListenMessage{Ref: "/path", Data: map[string]interface{}{"counter": float64(9)}})
+	c.assertNotOccurs()
+}
+
+func TestCoalesceMaxDelay(t *testing.T) {
+	ctx := context.Background()
+	handler, err := NewHandler(&Config{
+		CoalesceWindow:   50 * time.Millisecond,
+		CoalesceMaxDelay: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unable to new memory handler: %v", err)
+	}
+	ch := make(ListenChannel, 100)
+	_, err = handler.HandleListen(ctx, "/path", data.Query{}, ch)
+	assert.NoError(t, err)
+	<-ch
+
+	// continuous writes within the window are still notified by the max delay.
+	start := time.Now()
+	for i := 0; time.Since(start) < 300*time.Millisecond; i++ {
+		assert.NoError(t, handler.HandleSet(ctx, "/path/counter", float64(i)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, len(ch) >= 2, "%d notifications", len(ch))
+}
+
+func TestCoalesceClean(t *testing.T) {
+	flushed := make(chan context.Context, 1)
+	c := newCoalescer(context.Background(), 20*time.Millisecond, 0, func(ctx context.Context, subs []subscription) {
+		flushed <- ctx
+		<-ctx.Done()
+	})
+
+	// the pending subscriptions are never flushed after clean.
+	c.add(subscription{ref: "/path"})
+	c.clean()
+	select {
+	case <-flushed:
+		t.Fatal("unexpected flush after clean")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the running flush is cancelled by clean.
+	c.add(subscription{ref: "/path"})
+	ctx := <-flushed
+	assert.NoError(t, ctx.Err())
+	c.clean()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
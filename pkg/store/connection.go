@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+// infoRef defines the root of the virtual .info subtree, which is never persisted.
+const infoRef = "/.info"
+
+// isInfoRef checks whether the reference is inside the virtual .info subtree.
+func isInfoRef(ref string) bool {
+	return ref == infoRef || strings.HasPrefix(ref, infoRef+"/")
+}
+
+// connection defines the state of a client connection.
+type connection struct {
+	// disconnects defines the write requests to apply when disconnected.
+	disconnects []data.Request
+}
+
+type connections struct {
+	sync.RWMutex
+	c map[ListenChannel]*connection
+}
+
+func (c *connections) connect(ch ListenChannel) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.c[ch] = &connection{}
+}
+
+// disconnect removes the connection and returns the queued onDisconnect requests.
+func (c *connections) disconnect(ch ListenChannel) []data.Request {
+	c.Lock()
+	defer c.Unlock()
+
+	conn, ok := c.c[ch]
+	if !ok {
+		return nil
+	}
+	delete(c.c, ch)
+	return conn.disconnects
+}
+
+// onDisconnect queues a write request, or cancels the queued requests at or below
+// the reference of a cancel request.
+func (c *connections) onDisconnect(ch ListenChannel, r data.Request) error {
+	c.Lock()
+	defer c.Unlock()
+
+	conn, ok := c.c[ch]
+	if !ok {
+		return errors.New("connection not found")
+	}
+
+	if r.Type != data.TypeDisconnectCancel {
+		conn.disconnects = append(conn.disconnects, r)
+		return nil
+	}
+
+	// keep the requests outside the cancelled reference.
+	disconnects := conn.disconnects[:0]
+	for _, d := range conn.disconnects {
+		if d.Ref != r.Ref && !strings.HasPrefix(d.Ref, strings.TrimSuffix(r.Ref, "/")+"/") {
+			disconnects = append(disconnects, d)
+		}
+	}
+	conn.disconnects = disconnects
+	return nil
+}
+
+func (c *connections) clean() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.c = map[ListenChannel]*connection{}
+}
+
+// info resolves the value of a .info reference from the connection state of channel.
+func (c *connections) info(ref string, ch ListenChannel) interface{} {
+	c.RLock()
+	_, connected := c.c[ch]
+	c.RUnlock()
+
+	// the values never change while connected, so the listeners are answered only once.
+	// the server time offset is computed by clients from the handshake timestamp, which
+	// is unknown to server.
+	var v interface{} = map[string]interface{}{
+		"connected":        connected,
+		"serverTimeOffset": int64(0),
+	}
+
+	// walk down the virtual tree by the relative path.
+	for _, p := range strings.Split(strings.TrimPrefix(ref, infoRef), "/") {
+		if p == "" {
+			// leading space.
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 	"github.com/IguteChung/flakbase/pkg/db"
@@ -23,14 +24,24 @@ type ListenChannel chan (data.ListenMessage)
 type Handler interface {
 	// HandleSet handles operation set.
 	HandleSet(ctx context.Context, ref string, data interface{}) error
+	// HandleSetIf handles operation set if the hash of current data matches, returns
+	// the current data and whether it's set.
+	HandleSetIf(ctx context.Context, ref string, data interface{}, hash string) (interface{}, bool, error)
 	// HandleUpdate handles operation update.
 	HandleUpdate(ctx context.Context, ref string, data interface{}) error
 	// HandleListen handles the subscription of listen.
 	HandleListen(ctx context.Context, ref string, query data.Query, ch ListenChannel) (*ListenResult, error)
 	// HandleUnlisten handles the unsubscription of listen.
 	HandleUnlisten(ctx context.Context, ref string, query data.Query, ch ListenChannel) error
-	// HandleGet handles the operation get.
-	HandleGet(ctx context.Context, ref string, query data.Query) (interface{}, error)
+	// HandleGet handles the operation get, the virtual .info paths are resolved by the
+	// connection of listen channel, which is nil if not requested by a connection.
+	HandleGet(ctx context.Context, ref string, query data.Query, ch ListenChannel) (interface{}, error)
+	// HandleConnect registers the connection state of listen channel for the virtual .info paths.
+	HandleConnect(ctx context.Context, ch ListenChannel) error
+	// HandleOnDisconnect queues or cancels a write request applied when listen channel disconnects.
+	HandleOnDisconnect(ctx context.Context, r data.Request, ch ListenChannel) error
+	// HandleDisconnect cleans all listens of listen channel and applies the queued onDisconnect requests.
+	HandleDisconnect(ctx context.Context, ch ListenChannel) error
 	// Reset cleans all data stored, for testing purpose.
 	Reset(ctx context.Context) error
 }
@@ -39,6 +50,14 @@ type Handler interface {
 type Config struct {
 	Mongo string
 	Rule  string
+	// Namespace defines the isolated database to use, empty for the default one.
+	Namespace string
+	// CoalesceWindow defines the duration to merge the notifications of a listener,
+	// 0 to notify immediately on every write.
+	CoalesceWindow time.Duration
+	// CoalesceMaxDelay defines the max duration to postpone a notification by a burst
+	// of writes, at least CoalesceWindow.
+	CoalesceMaxDelay time.Duration
 }
 
 // NewHandler creates a Handler.
@@ -46,7 +65,7 @@ func NewHandler(c *Config) (Handler, error) {
 	// decide the db to use by config.
 	var db db.DB
 	if c.Mongo != "" {
-		mongo, err := mongodb.NewDB(c.Mongo)
+		mongo, err := mongodb.NewDB(c.Mongo, c.Namespace)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create mongo db %s: %v", c.Mongo, err)
 		}
@@ -64,10 +83,15 @@ func NewHandler(c *Config) (Handler, error) {
 	// set the db rules.
 	db.SetRules(r.Child("rules"))
 
-	return &handler{
-		l: &listeners{
-			l: map[string]map[ListenChannel]map[data.Query]bool{},
+	h := &handler{
+		l: newListeners(),
+		c: &connections{
+			c: map[ListenChannel]*connection{},
 		},
 		db: db,
-	}, nil
+	}
+	if c.CoalesceWindow > 0 {
+		h.coalescer = newCoalescer(context.Background(), c.CoalesceWindow, c.CoalesceMaxDelay, h.flush)
+	}
+	return h, nil
 }
@@ -2,7 +2,12 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 	"github.com/IguteChung/flakbase/pkg/rules"
@@ -104,6 +109,13 @@ func TestMongoHandlerSuite(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to new mongo handler: %v", err)
 	}
+
+	// skip if no mongodb is running.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := handler.Reset(ctx); err != nil {
+		t.Skipf("mongodb is unreachable: %v", err)
+	}
 	suite.Run(t, &handlerSuite{
 		handler: handler,
 	})
@@ -129,11 +141,11 @@ func (s *handlerSuite) TestInsertSingleDocument() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(doc("id1"), resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues("value1", resp)
 }
@@ -154,11 +166,11 @@ func (s *handlerSuite) TestInsertMultipleDocuments() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(doc("id1"), resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues("value1", resp)
 }
@@ -174,7 +186,7 @@ func (s *handlerSuite) TestInsertDocumentByUpdatePrimary() {
 		"/path/id2/number": float64(2),
 	}))
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{
 		"text":  "revised",
@@ -184,7 +196,7 @@ func (s *handlerSuite) TestInsertDocumentByUpdatePrimary() {
 		},
 	}, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id2", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id2", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{
 		"text":   "value2",
@@ -212,11 +224,11 @@ func (s *handlerSuite) TestReplaceDocument() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(doc("id2"), resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues("value2", resp)
 }
@@ -265,11 +277,11 @@ func (s *handlerSuite) TestUpdateDocumentField() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(updatedDoc["id1"], resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues("revised", resp)
 }
@@ -329,11 +341,11 @@ func (s *handlerSuite) TestUpdateMultipleDocumentsFields() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(updatedDoc["id1"], resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues("revised", resp)
 }
@@ -361,11 +373,11 @@ func (s *handlerSuite) TestDeleteDocuments() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(nil, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/text", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(nil, resp)
 }
@@ -389,6 +401,23 @@ func (s *handlerSuite) TestUnlisten() {
 	c2.assertNotOccurs()
 }
 
+func (s *handlerSuite) TestListenTrailingSlash() {
+	ctx := context.Background()
+	c1 := newMockListenChannel(s.T())
+	c2 := newMockListenChannel(s.T())
+	_, err := s.handler.HandleListen(ctx, "/path", data.Query{}, c1.ch)
+	s.NoError(err)
+	c1.assertOccurs(data.ListenMessage{Ref: "/path"})
+	_, err = s.handler.HandleListen(ctx, "/path/", data.Query{}, c2.ch)
+	s.NoError(err)
+	c2.assertOccurs(data.ListenMessage{Ref: "/path/"})
+
+	// each subscriber receives the reference it requested.
+	s.NoError(s.handler.HandleSet(ctx, "/path", "value"))
+	c1.assertOccurs(data.ListenMessage{Ref: "/path", Data: "value"})
+	c2.assertOccurs(data.ListenMessage{Ref: "/path/", Data: "value"})
+}
+
 func (s *handlerSuite) TestSetWithLongSize() {
 	// max size in mongodb is 120 bytes.
 	bytes := make([]byte, 300)
@@ -415,11 +444,11 @@ func (s *handlerSuite) TestSetDuplicatedPath() {
 	c1.assertNotOccurs()
 	c2.assertNotOccurs()
 
-	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{"id1": doc("id1")}, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path/id1/id1", data.Query{})
+	resp, err = s.handler.HandleGet(ctx, "/path/id1/id1", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(doc("id1"), resp)
 }
@@ -434,7 +463,7 @@ func (s *handlerSuite) testQuery(query data.Query, result map[string]interface{}
 	c.assertOccurs(data.ListenMessage{Ref: "/path", Data: result})
 	c.assertNotOccurs()
 
-	data, err := s.handler.HandleGet(ctx, "/path", query)
+	data, err := s.handler.HandleGet(ctx, "/path", query, nil)
 	s.NoError(err)
 	s.EqualValues(result, data)
 }
@@ -569,15 +598,15 @@ func (s *handlerSuite) TestShallowRoot() {
 	ctx := context.Background()
 	s.NoError(s.handler.HandleUpdate(ctx, "/path1/path2", doc()))
 
-	resp, err := s.handler.HandleGet(ctx, "/", data.Query{Shallow: true})
+	resp, err := s.handler.HandleGet(ctx, "/", data.Query{Shallow: true}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{"path1": true}, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path1", data.Query{Shallow: true})
+	resp, err = s.handler.HandleGet(ctx, "/path1", data.Query{Shallow: true}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{"path2": true}, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path1/path2", data.Query{Shallow: true})
+	resp, err = s.handler.HandleGet(ctx, "/path1/path2", data.Query{Shallow: true}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{
 		"id1": true,
@@ -586,7 +615,7 @@ func (s *handlerSuite) TestShallowRoot() {
 		"id4": true,
 	}, resp)
 
-	resp, err = s.handler.HandleGet(ctx, "/path1/path2/id1", data.Query{Shallow: true})
+	resp, err = s.handler.HandleGet(ctx, "/path1/path2/id1", data.Query{Shallow: true}, nil)
 	s.NoError(err)
 	s.EqualValues(doc("id1"), resp)
 }
@@ -612,7 +641,7 @@ func (s *handlerSuite) TestInsertDocumentByUpdateWithRules() {
 		},
 	}))
 
-	resp, err := s.handler.HandleGet(ctx, "/path", data.Query{})
+	resp, err := s.handler.HandleGet(ctx, "/path", data.Query{}, nil)
 	s.NoError(err)
 	s.EqualValues(map[string]interface{}{
 		"id1": doc("id1"),
@@ -626,3 +655,306 @@ func (s *handlerSuite) TestInsertDocumentByUpdateWithRules() {
 		},
 	}, resp)
 }
+
+func (s *handlerSuite) TestInfo() {
+	ctx := context.Background()
+	c := newMockListenChannel(s.T())
+	now := time.Unix(100, int64(250*time.Millisecond))
+	s.EqualValues(100250, data.InitMessage{Now: now}.Timestamp())
+	s.NoError(s.handler.HandleConnect(ctx, c.ch))
+	_, err := s.handler.HandleListen(ctx, "/.info/connected", data.Query{ID: 1}, c.ch)
+	s.NoError(err)
+	c.assertOccurs(data.ListenMessage{Ref: "/.info/connected", QueryID: 1, Data: true})
+	_, err = s.handler.HandleListen(ctx, "/.info/serverTimeOffset", data.Query{ID: 2}, c.ch)
+	s.NoError(err)
+	c.assertOccurs(data.ListenMessage{Ref: "/.info/serverTimeOffset", QueryID: 2, Data: int64(0)})
+	c.assertNotOccurs()
+
+	s.Error(s.handler.HandleSet(ctx, "/.info/connected", false))
+	s.Error(s.handler.HandleUpdate(ctx, "/", map[string]interface{}{".info/connected": false}))
+
+	resp, err := s.handler.HandleGet(ctx, "/.info/connected", data.Query{}, c.ch)
+	s.NoError(err)
+	s.EqualValues(true, resp)
+	resp, err = s.handler.HandleGet(ctx, "/.info/connected", data.Query{}, nil)
+	s.NoError(err)
+	s.EqualValues(false, resp)
+
+	s.NoError(s.handler.HandleDisconnect(ctx, c.ch))
+	s.NoError(s.handler.HandleSet(ctx, "/path/id1", doc("id1")))
+	c.assertNotOccurs()
+}
+
+func (s *handlerSuite) TestOnDisconnect() {
+	ctx := context.Background()
+	c1 := newMockListenChannel(s.T())
+	c2 := newMockListenChannel(s.T())
+	s.Error(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectSet, Ref: "/path/id1"}, c1.ch))
+	s.NoError(s.handler.HandleConnect(ctx, c1.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectSet, Ref: "/path/id1", Data: doc("id1")}, c1.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectUpdate, Ref: "/path", Data: map[string]interface{}{"id2": doc("id2")}}, c1.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectSet, Ref: "/path/id3/text", Data: "value3"}, c1.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectCancel, Ref: "/path/id3"}, c1.ch))
+
+	_, err := s.handler.HandleListen(ctx, "/path", data.Query{}, c1.ch)
+	s.NoError(err)
+	c1.assertOccurs(data.ListenMessage{Ref: "/path"})
+	_, err = s.handler.HandleListen(ctx, "/path/id1", data.Query{}, c2.ch)
+	s.NoError(err)
+	c2.assertOccurs(data.ListenMessage{Ref: "/path/id1"})
+
+	s.NoError(s.handler.HandleDisconnect(ctx, c1.ch))
+	c1.assertNotOccurs()
+	c2.assertOccurs(data.ListenMessage{Ref: "/path/id1", Data: doc("id1")})
+	c2.assertNotOccurs()
+
+	resp, err := s.handler.HandleGet(ctx, "/path", data.Query{}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{"id1": doc("id1"), "id2": doc("id2")}, resp)
+}
+
+func (s *handlerSuite) TestOnDisconnectFailure() {
+	ctx := context.Background()
+	c := newMockListenChannel(s.T())
+	s.NoError(s.handler.HandleConnect(ctx, c.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectSet, Ref: "/path/id1", Data: map[string]interface{}{"a$b": 1}}, c.ch))
+	s.NoError(s.handler.HandleOnDisconnect(ctx, data.Request{Type: data.TypeDisconnectSet, Ref: "/path/id2", Data: doc("id2")}, c.ch))
+
+	// the failed write is reported while the others are still applied.
+	err := s.handler.HandleDisconnect(ctx, c.ch)
+	s.Error(err)
+	s.Contains(err.Error(), "/path/id1")
+	resp, err := s.handler.HandleGet(ctx, "/path", data.Query{}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{"id2": doc("id2")}, resp)
+}
+
+func (s *handlerSuite) TestSharedView() {
+	ctx := context.Background()
+	c1 := newMockListenChannel(s.T())
+	c2 := newMockListenChannel(s.T())
+	query := data.Query{OrderBy: "number", Limit: 1}
+	query1, query2 := query, query
+	query1.ID, query2.ID = 1, 2
+	_, err := s.handler.HandleListen(ctx, "/path", query1, c1.ch)
+	s.NoError(err)
+	c1.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1})
+	_, err = s.handler.HandleListen(ctx, "/path", query2, c2.ch)
+	s.NoError(err)
+	c2.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 2})
+
+	// the identical queries are fanned out with their own query id.
+	s.NoError(s.handler.HandleSet(ctx, "/path/id1", doc("id1")))
+	c1.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1, Data: map[string]interface{}{"id1": doc("id1")}})
+	c2.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 2, Data: map[string]interface{}{"id1": doc("id1")}})
+	c1.assertNotOccurs()
+	c2.assertNotOccurs()
+}
+
+func (s *handlerSuite) TestWindowQuery() {
+	ctx := context.Background()
+	c := newMockListenChannel(s.T())
+	s.NoError(s.handler.HandleSet(ctx, "/path", doc()))
+	query := data.Query{ID: 1, OrderBy: "number", Limit: 2, LimitOrder: "r"}
+	_, err := s.handler.HandleListen(ctx, "/path", query, c.ch)
+	s.NoError(err)
+	c.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1, Data: map[string]interface{}{"id3": doc("id3"), "id4": doc("id4")}})
+
+	// a child out of window is not notified.
+	s.NoError(s.handler.HandleSet(ctx, "/path/id1/text", "changed"))
+	c.assertNotOccurs()
+
+	// a child changed within window is merged.
+	s.NoError(s.handler.HandleSet(ctx, "/path/id4/text", "changed"))
+	id4 := doc("id4")
+	id4["text"] = "changed"
+	c.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1, Data: map[string]interface{}{"id4": id4}, Merge: true})
+
+	// a child entering window evicts the boundary.
+	id5 := map[string]interface{}{"text": "value5", "number": float64(5)}
+	s.NoError(s.handler.HandleSet(ctx, "/path/id5", id5))
+	c.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1, Data: map[string]interface{}{"id5": id5, "id3": nil}, Merge: true})
+
+	// a child leaving window brings back the next one.
+	s.NoError(s.handler.HandleSet(ctx, "/path/id5", nil))
+	c.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1, Data: map[string]interface{}{"id5": nil, "id3": doc("id3")}, Merge: true})
+
+	// the whole reference removed is notified entirely.
+	s.NoError(s.handler.HandleSet(ctx, "/path", nil))
+	c.assertOccurs(data.ListenMessage{Ref: "/path", QueryID: 1})
+	c.assertNotOccurs()
+}
+
+func (s *handlerSuite) TestSetIf() {
+	ctx := context.Background()
+	c := newMockListenChannel(s.T())
+	_, err := s.handler.HandleListen(ctx, "/path/id1", data.Query{}, c.ch)
+	s.NoError(err)
+	c.assertOccurs(data.ListenMessage{Ref: "/path/id1"})
+
+	// the empty hash matches null data.
+	current, ok, err := s.handler.HandleSetIf(ctx, "/path/id1", doc("id1"), "")
+	s.NoError(err)
+	s.True(ok)
+	s.Nil(current)
+	c.assertOccurs(data.ListenMessage{Ref: "/path/id1", Data: doc("id1")})
+
+	// a stale hash is rejected with current data.
+	current, ok, err = s.handler.HandleSetIf(ctx, "/path/id1", doc("id2"), "")
+	s.NoError(err)
+	s.False(ok)
+	s.EqualValues(doc("id1"), current)
+	c.assertNotOccurs()
+
+	_, ok, err = s.handler.HandleSetIf(ctx, "/path/id1", nil, data.Hash(doc("id1")))
+	s.NoError(err)
+	s.True(ok)
+	c.assertOccurs(data.ListenMessage{Ref: "/path/id1"})
+}
+
+func (s *handlerSuite) TestInvalidKey() {
+	ctx := context.Background()
+	for _, key := range []string{"a.b", "a$b", "a#b", "a[b", "a]b", "a\x01b", strings.Repeat("a", 769)} {
+		err := s.handler.HandleSet(ctx, "/path", map[string]interface{}{key: "value"})
+		s.Equal(data.KindInvalid, data.KindOf(err), key)
+		err = s.handler.HandleSet(ctx, "/path/"+key, "value")
+		s.Equal(data.KindInvalid, data.KindOf(err), key)
+	}
+	err := s.handler.HandleUpdate(ctx, "/path", map[string]interface{}{"id1": "value", "id2": map[string]interface{}{"a.b": "value"}})
+	s.Equal(data.KindInvalid, data.KindOf(err))
+	err = s.handler.HandleSet(ctx, "/path", []interface{}{"value", map[string]interface{}{"a.b": "value"}})
+	s.Equal(data.KindInvalid, data.KindOf(err))
+
+	// a long key is truncated in message without splitting a rune.
+	err = s.handler.HandleSet(ctx, "/path/a"+strings.Repeat("流", 256), "value")
+	s.Equal(data.KindInvalid, data.KindOf(err))
+	s.True(utf8.ValidString(err.Error()), err.Error())
+	s.Equal(data.KindPermission, data.KindOf(s.handler.HandleSet(ctx, "/.info/connected", false)))
+
+	// nothing is written if any entry is invalid.
+	resp, err := s.handler.HandleGet(ctx, "/path", data.Query{}, nil)
+	s.NoError(err)
+	s.Nil(resp)
+}
+
+func (s *handlerSuite) TestCancelledContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.handler.HandleGet(ctx, "/path", data.Query{}, nil)
+	s.Error(err)
+	s.Error(s.handler.HandleSet(ctx, "/path", "value"))
+
+	resp, err := s.handler.HandleGet(context.Background(), "/path", data.Query{}, nil)
+	s.NoError(err)
+	s.Nil(resp)
+}
+
+func (s *handlerSuite) TestOrderByMixedValues() {
+	ctx := context.Background()
+	s.NoError(s.handler.HandleSet(ctx, "/scores", map[string]interface{}{
+		"id1": map[string]interface{}{"score": 10},
+		"id2": map[string]interface{}{"score": 9},
+		"id3": map[string]interface{}{"score": "8"},
+		"id4": map[string]interface{}{"score": false},
+		"id5": map[string]interface{}{"name": "none"},
+	}))
+
+	// numbers are ordered numerically after booleans and before strings.
+	resp, err := s.handler.HandleGet(ctx, "/scores", data.Query{OrderBy: "score", StartAt: 9, Limit: 2, LimitOrder: "l"}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{
+		"id1": map[string]interface{}{"score": 10},
+		"id2": map[string]interface{}{"score": 9},
+	}, resp)
+	resp, err = s.handler.HandleGet(ctx, "/scores", data.Query{OrderBy: "score", Limit: 2, LimitOrder: "l"}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{
+		"id4": map[string]interface{}{"score": false},
+		"id5": map[string]interface{}{"name": "none"},
+	}, resp)
+}
+
+func (s *handlerSuite) TestPriority() {
+	ctx := context.Background()
+	c := newMockListenChannel(s.T())
+	_, err := s.handler.HandleListen(ctx, "/players", data.Query{ID: 1, Limit: 2, LimitOrder: "l"}, c.ch)
+	s.NoError(err)
+	c.assertOccurs(data.ListenMessage{Ref: "/players", QueryID: 1})
+
+	// set with priority.
+	s.NoError(s.handler.HandleSet(ctx, "/players", map[string]interface{}{
+		"id1": map[string]interface{}{".value": "first", ".priority": float64(3)},
+		"id2": map[string]interface{}{"name": "second", ".priority": float64(1)},
+		"id3": map[string]interface{}{".value": "third", ".priority": float64(2)},
+	}))
+	c.assertOccurs(data.ListenMessage{Ref: "/players", QueryID: 1, Data: map[string]interface{}{
+		"id2": map[string]interface{}{"name": "second", ".priority": float64(1)},
+		"id3": map[string]interface{}{".value": "third", ".priority": float64(2)},
+	}})
+
+	// set the priority only, the data is kept.
+	s.NoError(s.handler.HandleSet(ctx, "/players/id1/.priority", float64(0)))
+	c.assertOccurs(data.ListenMessage{Ref: "/players", QueryID: 1, Merge: true, Data: map[string]interface{}{
+		"id1": map[string]interface{}{".value": "first", ".priority": float64(0)},
+		"id3": nil,
+	}})
+	s.NoError(s.handler.HandleUpdate(ctx, "/players/id2", map[string]interface{}{".priority": nil}))
+	c.assertOccurs(data.ListenMessage{Ref: "/players", QueryID: 1, Merge: true, Data: map[string]interface{}{
+		"id2": map[string]interface{}{"name": "second"},
+	}})
+
+	resp, err := s.handler.HandleGet(ctx, "/players", data.Query{OrderBy: "$priority", StartAt: float64(1), Limit: 2, LimitOrder: "l"}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{
+		"id3": map[string]interface{}{".value": "third", ".priority": float64(2)},
+	}, resp)
+
+	// writing below a leaf with priority makes it a node, the priority is kept.
+	s.NoError(s.handler.HandleSet(ctx, "/players/id3/name", "third"))
+	resp, err = s.handler.HandleGet(ctx, "/players/id3", data.Query{}, nil)
+	s.NoError(err)
+	s.EqualValues(map[string]interface{}{"name": "third", ".priority": float64(2)}, resp)
+
+	// a priority must be a number or string.
+	s.Equal(data.KindInvalid, data.KindOf(s.handler.HandleSet(ctx, "/players/id1/.priority", true)))
+	s.Equal(data.KindInvalid, data.KindOf(s.handler.HandleSet(ctx, "/players/id1", map[string]interface{}{".value": "first", "other": 1})))
+}
+
+func (s *handlerSuite) TestConcurrentPriority() {
+	ctx := context.Background()
+	s.NoError(s.handler.HandleSet(ctx, "/scores/p", map[string]interface{}{"c0": float64(0)}))
+
+	// the children set concurrently are not lost by setting the priority.
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.NoError(s.handler.HandleSet(ctx, fmt.Sprintf("/scores/p/c%d", i), float64(i)))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			s.NoError(s.handler.HandleSet(ctx, "/scores/p/.priority", float64(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := s.handler.HandleGet(ctx, "/scores/p", data.Query{}, nil)
+	s.NoError(err)
+	m, ok := resp.(map[string]interface{})
+	s.True(ok)
+	s.Contains(m, data.PriorityKey)
+	for i := 0; i <= 50; i++ {
+		s.Equal(float64(i), m[fmt.Sprintf("c%d", i)])
+	}
+
+	// the priority of a bare leaf wraps it, and is removed back to the leaf.
+	s.NoError(s.handler.HandleSet(ctx, "/scores/p/c0/.priority", "low"))
+	resp, err = s.handler.HandleGet(ctx, "/scores/p/c0", data.Query{}, nil)
+	s.NoError(err)
+	s.Equal(map[string]interface{}{".value": float64(0), ".priority": "low"}, resp)
+	s.NoError(s.handler.HandleSet(ctx, "/scores/p/c0/.priority", nil))
+	resp, err = s.handler.HandleGet(ctx, "/scores/p/c0", data.Query{}, nil)
+	s.NoError(err)
+	s.Equal(float64(0), resp)
+}
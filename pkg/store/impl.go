@@ -3,7 +3,9 @@ package store
 import (
 	"context"
 	"fmt"
+	"log"
 	"path"
+	"strings"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 	"github.com/IguteChung/flakbase/pkg/db"
@@ -11,10 +13,21 @@ import (
 
 type handler struct {
 	l  *listeners
+	c  *connections
 	db db.DB
+	// coalescer defines the optional coalescer to notify listeners per window.
+	coalescer *coalescer
 }
 
-func (s *handler) HandleSet(ctx context.Context, ref string, data interface{}) error {
+func (s *handler) HandleSet(ctx context.Context, ref string, value interface{}) error {
+	// the virtual .info paths are read only.
+	if isInfoRef(ref) {
+		return data.Errorf(data.KindPermission, "failed to set data to %s: .info is read only", ref)
+	}
+	if err := validateWrite(ref, value); err != nil {
+		return err
+	}
+
 	// connect to db.
 	client, err := s.db.Connect(ctx)
 	if err != nil {
@@ -23,18 +36,79 @@ func (s *handler) HandleSet(ctx context.Context, ref string, data interface{}) e
 	defer client.Close()
 
 	// set the data to DB.
-	if err := client.Set(ctx, ref, data); err != nil {
-		return fmt.Errorf("failed to set data to %s: %v", ref, err)
+	written, err := setData(ctx, client, ref, value)
+	if err != nil {
+		return data.Wrapf(err, "failed to set data to %s", ref)
 	}
 
 	// callback the data.
-	if err := s.callbackRef(ctx, client, ref); err != nil {
+	if err := s.callbackRef(ctx, client, written); err != nil {
 		return fmt.Errorf("failed to callback set %s: %v", ref, err)
 	}
 	return nil
 }
 
-func (s *handler) HandleUpdate(ctx context.Context, ref string, data interface{}) error {
+func (s *handler) HandleSetIf(ctx context.Context, ref string, value interface{}, hash string) (interface{}, bool, error) {
+	// the virtual .info paths are read only.
+	if isInfoRef(ref) {
+		return nil, false, data.Errorf(data.KindPermission, "failed to set data to %s: .info is read only", ref)
+	}
+	if err := validateWrite(ref, value); err != nil {
+		return nil, false, err
+	}
+	if path.Base(ref) == data.PriorityKey {
+		return nil, false, data.Errorf(data.KindInvalid, "failed to set data to %s: priority cannot be set conditionally", ref)
+	}
+
+	// connect to db.
+	client, err := s.db.Connect(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to DB: %v", err)
+	}
+	defer client.Close()
+
+	// compare the hash and set the data to DB.
+	current, ok, err := client.SetIf(ctx, ref, value, func(current interface{}) bool {
+		return data.Hash(current) == hash
+	})
+	if err != nil {
+		return nil, false, data.Wrapf(err, "failed to set data to %s", ref)
+	} else if !ok {
+		return current, false, nil
+	}
+
+	// callback the data.
+	if err := s.callbackRef(ctx, client, ref); err != nil {
+		return nil, false, fmt.Errorf("failed to callback set %s: %v", ref, err)
+	}
+	return current, true, nil
+}
+
+func (s *handler) HandleUpdate(ctx context.Context, ref string, value interface{}) error {
+	// the virtual .info paths are read only.
+	if isInfoRef(ref) {
+		return data.Errorf(data.KindPermission, "failed to update data to %s: .info is read only", ref)
+	}
+	if err := validateRef(ref); err != nil {
+		return err
+	}
+
+	// validate all the entries before writing any of them.
+	m, isMap := value.(map[string]interface{})
+	if isMap {
+		for k, v := range m {
+			updatedRef := path.Join(ref, k)
+			if isInfoRef(updatedRef) {
+				return data.Errorf(data.KindPermission, "failed to update data to %s: .info is read only", updatedRef)
+			}
+			if err := validateWrite(updatedRef, v); err != nil {
+				return err
+			}
+		}
+	} else if err := validateData(value); err != nil {
+		return err
+	}
+
 	// connect to db.
 	client, err := s.db.Connect(ctx)
 	if err != nil {
@@ -44,21 +118,22 @@ func (s *handler) HandleUpdate(ctx context.Context, ref string, data interface{}
 
 	// if the data is a map, set the data sequentially.
 	changedRefs := []string{}
-	if m, ok := data.(map[string]interface{}); ok {
+	if isMap {
 		// TODO: set entries in transaction.
 		for k, v := range m {
-			updatedRef := path.Join(ref, k)
-			changedRefs = append(changedRefs, updatedRef)
-			if err := client.Set(ctx, updatedRef, v); err != nil {
-				return fmt.Errorf("failed to update data to %s: %v", ref, err)
+			written, err := setData(ctx, client, path.Join(ref, k), v)
+			if err != nil {
+				return data.Wrapf(err, "failed to update data to %s", ref)
 			}
+			changedRefs = append(changedRefs, written)
 		}
 	} else {
 		// directly call set if data is not a map.
-		changedRefs = []string{ref}
-		if err := client.Set(ctx, ref, data); err != nil {
-			return fmt.Errorf("failed to set data to %s: %v", ref, err)
+		written, err := setData(ctx, client, ref, value)
+		if err != nil {
+			return data.Wrapf(err, "failed to set data to %s", ref)
 		}
+		changedRefs = []string{written}
 	}
 
 	// callback the data.
@@ -70,6 +145,19 @@ func (s *handler) HandleUpdate(ctx context.Context, ref string, data interface{}
 }
 
 func (s *handler) HandleListen(ctx context.Context, ref string, query data.Query, ch ListenChannel) (*ListenResult, error) {
+	// answer the virtual .info paths from connection state.
+	if isInfoRef(ref) {
+		ch <- data.ListenMessage{
+			Ref:     ref,
+			QueryID: query.ID,
+			Data:    s.c.info(ref, ch),
+		}
+		return &ListenResult{}, nil
+	}
+	if err := validateRef(ref); err != nil {
+		return nil, err
+	}
+
 	// register the listener.
 	s.l.register(ref, ch, query)
 
@@ -85,11 +173,14 @@ func (s *handler) HandleListen(ctx context.Context, ref string, query data.Query
 	if err != nil {
 		return nil, fmt.Errorf("failed to get %s: %v", ref, err)
 	}
-	ch <- data.ListenMessage{
+	if w := s.l.window(newView(ref, query)); w != nil {
+		w.seed(resp)
+	}
+	s.l.send(ref, ch, query, data.ListenMessage{
 		Ref:     ref,
 		QueryID: query.ID,
 		Data:    resp,
-	}
+	})
 	return &ListenResult{}, nil
 }
 
@@ -98,7 +189,15 @@ func (s *handler) HandleUnlisten(ctx context.Context, ref string, query data.Que
 	return nil
 }
 
-func (s *handler) HandleGet(ctx context.Context, ref string, query data.Query) (interface{}, error) {
+func (s *handler) HandleGet(ctx context.Context, ref string, query data.Query, ch ListenChannel) (interface{}, error) {
+	// answer the virtual .info paths from connection state.
+	if isInfoRef(ref) {
+		return s.c.info(ref, ch), nil
+	}
+	if err := validateRef(ref); err != nil {
+		return nil, err
+	}
+
 	// connect to db.
 	client, err := s.db.Connect(ctx)
 	if err != nil {
@@ -114,9 +213,62 @@ func (s *handler) HandleGet(ctx context.Context, ref string, query data.Query) (
 	return resp, nil
 }
 
+func (s *handler) HandleConnect(ctx context.Context, ch ListenChannel) error {
+	s.c.connect(ch)
+	return nil
+}
+
+func (s *handler) HandleOnDisconnect(ctx context.Context, r data.Request, ch ListenChannel) error {
+	// validate the write request before queueing.
+	if isInfoRef(r.Ref) {
+		return data.Errorf(data.KindPermission, "failed to queue onDisconnect %s: .info is read only", r.Ref)
+	}
+	if err := validateRef(r.Ref); err != nil {
+		return err
+	}
+	switch r.Type {
+	case data.TypeDisconnectSet, data.TypeDisconnectUpdate, data.TypeDisconnectCancel:
+	default:
+		return data.Errorf(data.KindInvalid, "invalid onDisconnect type %d", r.Type)
+	}
+
+	if err := s.c.onDisconnect(ch, r); err != nil {
+		return fmt.Errorf("failed to queue onDisconnect %s: %v", r.Ref, err)
+	}
+	return nil
+}
+
+func (s *handler) HandleDisconnect(ctx context.Context, ch ListenChannel) error {
+	// stop notifying the channel first.
+	s.l.unregisterAll(ch)
+
+	// apply all the queued onDisconnect requests in order, a failed one doesn't
+	// prevent the others.
+	var errs []string
+	for _, r := range s.c.disconnect(ch) {
+		var err error
+		if r.Type == data.TypeDisconnectSet {
+			err = s.HandleSet(ctx, r.Ref, r.Data)
+		} else {
+			err = s.HandleUpdate(ctx, r.Ref, r.Data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", r.Ref, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to handle onDisconnect %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 func (s *handler) Reset(ctx context.Context) error {
-	// clean the listener.
+	// clean the listener, connections and pending notifications.
 	s.l.clean()
+	s.c.clean()
+	if s.coalescer != nil {
+		s.coalescer.clean()
+	}
 
 	// clean db rules.
 	s.db.SetRules(nil)
@@ -132,22 +284,95 @@ func (s *handler) Reset(ctx context.Context) error {
 	return client.Reset(ctx)
 }
 
+// setData sets the data to reference, a priority reference sets the priority of its
+// parent node instead. It returns the reference written.
+func setData(ctx context.Context, client db.Client, ref string, value interface{}) (string, error) {
+	if path.Base(ref) != data.PriorityKey {
+		return ref, client.Set(ctx, ref, value)
+	}
+
+	parent := path.Dir(ref)
+	return parent, client.SetPriority(ctx, parent, value)
+}
+
 func (s *handler) callbackRef(ctx context.Context, client db.Client, updatedRefs ...string) error {
+	var subs []subscription
 	for _, ref := range s.l.find(updatedRefs...) {
-		for ch, queries := range s.l.l[ref] {
-			for query := range queries {
-				// TODO: consider load changed data in parallel.
-				resp, err := client.Get(ctx, ref, query)
-				if err != nil {
-					return fmt.Errorf("failed to callback %s: %v", ref, err)
-				}
-				ch <- data.ListenMessage{
-					Ref:     ref,
-					QueryID: query.ID,
-					Data:    resp,
-				}
+		subs = append(subs, s.l.subscriptions(ref)...)
+	}
+
+	// leave the notifications to coalescer if enabled.
+	if s.coalescer != nil {
+		s.coalescer.add(subs...)
+		return nil
+	}
+	return s.notify(ctx, client, subs, updatedRefs)
+}
+
+// notify evaluates each view of subscriptions once and sends the data to subscribers
+// with their own query id, the updated references are unknown if empty.
+func (s *handler) notify(ctx context.Context, client db.Client, subs []subscription, updatedRefs []string) error {
+	for v, subs := range views(subs) {
+		// maintain the window incrementally for limit or range queries.
+		if w := s.l.window(v); w != nil {
+			if err := s.notifyWindow(ctx, client, w, v, subs, updatedRefs); err != nil {
+				return fmt.Errorf("failed to callback %s: %v", v.ref, err)
 			}
+			continue
+		}
+
+		// TODO: consider load changed data in parallel.
+		resp, err := client.Get(ctx, v.ref, v.query)
+		if err != nil {
+			return fmt.Errorf("failed to callback %s: %v", v.ref, err)
+		}
+		for _, sub := range subs {
+			s.l.send(sub.ref, sub.ch, sub.query, data.ListenMessage{
+				Ref:     sub.origin,
+				QueryID: sub.query.ID,
+				Data:    resp,
+			})
 		}
 	}
 	return nil
 }
+
+// notifyWindow sends the changes of window to subscribers, the window is locked until
+// sent to keep the changes in order.
+func (s *handler) notifyWindow(ctx context.Context, client db.Client, w *window, v view, subs []subscription, updatedRefs []string) error {
+	w.Lock()
+	defer w.Unlock()
+
+	changes, merge, err := w.update(ctx, client, v.ref, updatedRefs)
+	if err != nil {
+		return err
+	}
+	if changes == nil && merge {
+		// nothing changed in window.
+		return nil
+	}
+	for _, sub := range subs {
+		s.l.send(sub.ref, sub.ch, sub.query, data.ListenMessage{
+			Ref:     sub.origin,
+			QueryID: sub.query.ID,
+			Data:    changes,
+			Merge:   merge,
+		})
+	}
+	return nil
+}
+
+// flush notifies the coalesced subscriptions with the latest data.
+func (s *handler) flush(ctx context.Context, subs []subscription) {
+	// connect to db.
+	client, err := s.db.Connect(ctx)
+	if err != nil {
+		log.Printf("failed to connect to DB: %v", err)
+		return
+	}
+	defer client.Close()
+
+	if err := s.notify(ctx, client, subs, nil); err != nil {
+		log.Printf("failed to flush notifications: %v", err)
+	}
+}
@@ -7,54 +7,318 @@ import (
 	"github.com/IguteChung/flakbase/pkg/data"
 )
 
+// subscription defines a query listened by a channel.
+type subscription struct {
+	ref   string
+	ch    ListenChannel
+	query data.Query
+	// origin defines the reference requested by the subscriber, which may differ from
+	// ref by slashes and is echoed back in messages.
+	origin string
+}
+
+// view defines the subscriptions sharing the same reference and query regardless of
+// the query id, which are evaluated once and fanned out.
+type view struct {
+	ref   string
+	query data.Query
+}
+
+func newView(ref string, query data.Query) view {
+	query.ID = 0
+	return view{ref: ref, query: query}
+}
+
+// views groups the subscriptions by view.
+func views(subs []subscription) map[view][]subscription {
+	views := map[view][]subscription{}
+	for _, sub := range subs {
+		v := newView(sub.ref, sub.query)
+		views[v] = append(views[v], sub)
+	}
+	return views
+}
+
+// listenerNode defines a node of the listener trie keyed by path segments.
+type listenerNode struct {
+	ref      string
+	children map[string]*listenerNode
+	// chs defines the queries of each channel and the references they requested.
+	chs map[ListenChannel]map[data.Query]string
+	// windows defines the windows of limit or range queries keyed by the query without id.
+	windows map[data.Query]*window
+}
+
+func newListenerNode() *listenerNode {
+	return &listenerNode{
+		children: map[string]*listenerNode{},
+		chs:      map[ListenChannel]map[data.Query]string{},
+		windows:  map[data.Query]*window{},
+	}
+}
+
+// pruneWindows removes the windows no longer listened.
+func (n *listenerNode) pruneWindows() {
+	if len(n.windows) == 0 {
+		return
+	}
+	listened := map[data.Query]bool{}
+	for _, queries := range n.chs {
+		for query := range queries {
+			listened[newView(n.ref, query).query] = true
+		}
+	}
+	for query := range n.windows {
+		if !listened[query] {
+			delete(n.windows, query)
+		}
+	}
+}
+
+// empty returns true if the node can be pruned.
+func (n *listenerNode) empty() bool {
+	return len(n.children) == 0 && len(n.chs) == 0
+}
+
+// collect appends the references listened in the subtree of node.
+func (n *listenerNode) collect(refs map[string]bool) {
+	if len(n.chs) > 0 {
+		refs[n.ref] = true
+	}
+	for _, child := range n.children {
+		child.collect(refs)
+	}
+}
+
+// unregisterAll removes the channel from the subtree, returns true if the node is empty.
+func (n *listenerNode) unregisterAll(ch ListenChannel) bool {
+	if _, ok := n.chs[ch]; ok {
+		delete(n.chs, ch)
+		n.pruneWindows()
+	}
+	for segment, child := range n.children {
+		if child.unregisterAll(ch) {
+			delete(n.children, segment)
+		}
+	}
+	return n.empty()
+}
+
+// segments splits the reference into path segments, the root has no segment.
+func segments(ref string) []string {
+	ref = strings.Trim(ref, "/")
+	if ref == "" {
+		return nil
+	}
+	return strings.Split(ref, "/")
+}
+
+// listeners defines the concurrency safe trie of listened references.
 type listeners struct {
-	sync.Mutex
-	l map[string]map[ListenChannel]map[data.Query]bool
+	sync.RWMutex
+	root *listenerNode
+	// guards serializes the sends to a channel with its unregistration, so that a
+	// blocking channel doesn't hold the whole trie.
+	guards map[ListenChannel]*sync.RWMutex
+}
+
+func newListeners() *listeners {
+	return &listeners{root: newListenerNode(), guards: map[ListenChannel]*sync.RWMutex{}}
+}
+
+// registered returns true if the channel listens the query at reference.
+func (l *listeners) registered(ref string, ch ListenChannel, query data.Query) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	if n := l.node(ref); n != nil {
+		_, ok := n.chs[ch][query]
+		return ok
+	}
+	return false
+}
+
+// waitSends waits for the sends to channel in progress.
+func waitSends(guard *sync.RWMutex) {
+	if guard != nil {
+		guard.Lock()
+		guard.Unlock()
+	}
+}
+
+// node returns the node of reference, nil if not found.
+func (l *listeners) node(ref string) *listenerNode {
+	n := l.root
+	for _, segment := range segments(ref) {
+		if n = n.children[segment]; n == nil {
+			return nil
+		}
+	}
+	return n
 }
 
 func (l *listeners) register(ref string, ch ListenChannel, query data.Query) {
 	l.Lock()
 	defer l.Unlock()
 
-	if _, ok := l.l[ref]; !ok {
-		l.l[ref] = map[ListenChannel]map[data.Query]bool{}
+	n := l.root
+	for _, segment := range segments(ref) {
+		child, ok := n.children[segment]
+		if !ok {
+			child = newListenerNode()
+			n.children[segment] = child
+		}
+		n = child
+	}
+	if _, ok := n.chs[ch]; !ok {
+		n.chs[ch] = map[data.Query]string{}
 	}
-	if _, ok := l.l[ref][ch]; !ok {
-		l.l[ref][ch] = map[data.Query]bool{}
+	if _, ok := l.guards[ch]; !ok {
+		l.guards[ch] = &sync.RWMutex{}
 	}
 
-	l.l[ref][ch][query] = true
+	// the references that differ by slashes share the node with a canonical reference.
+	n.ref = "/" + strings.Join(segments(ref), "/")
+	n.chs[ch][query] = ref
 }
 
 func (l *listeners) unregister(ref string, ch ListenChannel, query data.Query) {
 	l.Lock()
-	defer l.Unlock()
+	guard := l.guards[ch]
+	l.remove(ref, ch, query)
+	l.Unlock()
+
+	waitSends(guard)
+}
+
+// remove removes the query of channel from the trie, the lock must be held.
+func (l *listeners) remove(ref string, ch ListenChannel, query data.Query) {
+	// record the path to prune the empty nodes.
+	path := []*listenerNode{l.root}
+	segs := segments(ref)
+	for _, segment := range segs {
+		child, ok := path[len(path)-1].children[segment]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
 
-	if chs, ok := l.l[ref]; ok {
-		if queries, ok := chs[ch]; ok {
-			delete(queries, query)
+	n := path[len(path)-1]
+	if queries, ok := n.chs[ch]; ok {
+		delete(queries, query)
+		if len(queries) == 0 {
+			delete(n.chs, ch)
 		}
+		n.pruneWindows()
+	}
+	for i := len(segs); i > 0 && path[i].empty(); i-- {
+		delete(path[i-1].children, segs[i-1])
 	}
 }
 
+func (l *listeners) unregisterAll(ch ListenChannel) {
+	l.Lock()
+	guard := l.guards[ch]
+	delete(l.guards, ch)
+	l.root.unregisterAll(ch)
+	l.Unlock()
+
+	waitSends(guard)
+}
+
 func (l *listeners) clean() {
 	l.Lock()
 	defer l.Unlock()
 
-	l.l = map[string]map[ListenChannel]map[data.Query]bool{}
+	l.root = newListenerNode()
+	l.guards = map[ListenChannel]*sync.RWMutex{}
 }
 
-// find matches the listeners and returns matched references.
+// subscriptions returns a snapshot of the channels and queries listening to reference.
+func (l *listeners) subscriptions(ref string) []subscription {
+	l.RLock()
+	defer l.RUnlock()
+
+	var subs []subscription
+	if n := l.node(ref); n != nil {
+		for ch, queries := range n.chs {
+			for query, origin := range queries {
+				subs = append(subs, subscription{ref: n.ref, ch: ch, query: query, origin: origin})
+			}
+		}
+	}
+	return subs
+}
+
+// window returns the window of a listened limit or range query, nil if the query is
+// not listened or not windowed.
+func (l *listeners) window(v view) *window {
+	if !v.query.Windowed() || v.query.Shallow {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	n := l.node(v.ref)
+	if n == nil || len(n.chs) == 0 {
+		return nil
+	}
+	w, ok := n.windows[v.query]
+	if !ok {
+		w = &window{query: v.query}
+		n.windows[v.query] = w
+	}
+	return w
+}
+
+// send sends the message to channel only if the listen is still registered, the
+// guard of channel guarantees no message is sent after the channel unregistered.
+func (l *listeners) send(ref string, ch ListenChannel, query data.Query, msg data.ListenMessage) {
+	l.RLock()
+	guard := l.guards[ch]
+	l.RUnlock()
+	if guard == nil {
+		return
+	}
+
+	// the trie is not locked while the channel blocks.
+	guard.RLock()
+	defer guard.RUnlock()
+	if l.registered(ref, ch, query) {
+		ch <- msg
+	}
+}
+
+// find matches the listeners and returns matched references, which are the ancestors
+// and descendants of the updated references.
 func (l *listeners) find(updatedRefs ...string) []string {
-	refs := make([]string, 0, len(l.l))
-	for ref := range l.l {
-		for _, updatedRef := range updatedRefs {
-			refPath, updatedRefPath := ref+"/", updatedRef+"/"
-			if ref == "/" || strings.HasPrefix(refPath, updatedRefPath) || strings.HasPrefix(updatedRefPath, refPath) {
-				refs = append(refs, ref)
+	l.RLock()
+	defer l.RUnlock()
+
+	matched := map[string]bool{}
+	for _, updatedRef := range updatedRefs {
+		// collect the ancestors along the path.
+		n := l.root
+		for _, segment := range segments(updatedRef) {
+			if len(n.chs) > 0 {
+				matched[n.ref] = true
+			}
+			if n = n.children[segment]; n == nil {
 				break
 			}
 		}
+
+		// collect the updated reference and its descendants.
+		if n != nil {
+			n.collect(matched)
+		}
+	}
+
+	refs := make([]string, 0, len(matched))
+	for ref := range matched {
+		refs = append(refs, ref)
 	}
 	return refs
 }
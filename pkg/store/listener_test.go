@@ -1,7 +1,10 @@
 package store
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/IguteChung/flakbase/pkg/data"
 	"github.com/stretchr/testify/assert"
@@ -20,15 +23,17 @@ func assertContainsOnly(t *testing.T, s interface{}, contains ...interface{}) bo
 }
 
 func TestFindReferences(t *testing.T) {
-	l := &listeners{
-		l: map[string]map[ListenChannel]map[data.Query]bool{
-			"/":                                 nil,
-			"/path":                             nil,
-			"/path/collection/document1":        nil,
-			"/path/collection/document2":        nil,
-			"/path/collection2/document1":       nil,
-			"/path/collection2/document1/field": nil,
-		},
+	l := newListeners()
+	ch := make(ListenChannel)
+	for _, ref := range []string{
+		"/",
+		"/path",
+		"/path/collection/document1",
+		"/path/collection/document2",
+		"/path/collection2/document1",
+		"/path/collection2/document1/field",
+	} {
+		l.register(ref, ch, data.Query{})
 	}
 
 	assertContainsOnly(t, l.find("/path2"), "/")
@@ -72,3 +77,126 @@ func TestFindReferences(t *testing.T) {
 		"/path/collection2/document1/field",
 	)
 }
+
+func TestUnregisterReferences(t *testing.T) {
+	l := newListeners()
+	ch1, ch2 := make(ListenChannel), make(ListenChannel)
+	l.register("/path", ch1, data.Query{})
+	l.register("/path", ch1, data.Query{ID: 1})
+	l.register("/path/collection/document1", ch2, data.Query{})
+
+	l.unregister("/path", ch1, data.Query{})
+	assertContainsOnly(t, l.find("/path/collection"), "/path", "/path/collection/document1")
+	l.unregister("/path", ch1, data.Query{ID: 1})
+	assertContainsOnly(t, l.find("/path/collection"), "/path/collection/document1")
+
+	// the empty nodes are pruned.
+	l.unregisterAll(ch2)
+	assert.Empty(t, l.find("/"))
+	assert.Empty(t, l.root.children)
+}
+
+func TestConcurrentListeners(t *testing.T) {
+	l := newListeners()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ch := make(ListenChannel)
+			ref := fmt.Sprintf("/path/collection%d/document", i)
+			for j := 0; j < 100; j++ {
+				l.register(ref, ch, data.Query{})
+				l.find("/path")
+				l.subscriptions(ref)
+				l.unregister(ref, ch, data.Query{})
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Empty(t, l.find("/"))
+}
+
+func TestBlockedSend(t *testing.T) {
+	l := newListeners()
+	ch1, ch2 := make(ListenChannel), make(ListenChannel)
+	l.register("/path", ch1, data.Query{})
+
+	// a send blocked on a channel doesn't block the others.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		l.send("/path", ch1, data.Query{}, data.ListenMessage{Ref: "/path"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.register("/path", ch2, data.Query{})
+	assertContainsOnly(t, l.find("/path"), "/path")
+
+	// unregister waits for the send in progress, no message is sent after that.
+	unregistered := make(chan struct{})
+	go func() {
+		defer close(unregistered)
+		l.unregisterAll(ch1)
+	}()
+	select {
+	case <-unregistered:
+		t.Fatal("unregistered before the send completed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, data.ListenMessage{Ref: "/path"}, <-ch1)
+	<-sent
+	<-unregistered
+	l.send("/path", ch1, data.Query{}, data.ListenMessage{Ref: "/path"})
+}
+
+// newBenchmarkListeners registers 100k listeners across 100 collections.
+func newBenchmarkListeners() *listeners {
+	l := newListeners()
+	for i := 0; i < 100000; i++ {
+		l.register(fmt.Sprintf("/path/collection%d/document%d", i%100, i), make(ListenChannel), data.Query{})
+	}
+	return l
+}
+
+func BenchmarkFindDocument(b *testing.B) {
+	l := newBenchmarkListeners()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.find(fmt.Sprintf("/path/collection%d/document%d/field", i%100, i%100000))
+	}
+}
+
+func BenchmarkFindCollection(b *testing.B) {
+	l := newBenchmarkListeners()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.find(fmt.Sprintf("/path/collection%d", i%100))
+	}
+}
+
+func BenchmarkRegister(b *testing.B) {
+	l := newBenchmarkListeners()
+	ch := make(ListenChannel)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ref := fmt.Sprintf("/path/collection%d/document%d", i%100, i)
+		l.register(ref, ch, data.Query{})
+		l.unregister(ref, ch, data.Query{})
+	}
+}
+
+func TestViews(t *testing.T) {
+	ch1, ch2 := make(ListenChannel), make(ListenChannel)
+	subs := []subscription{
+		{ref: "/path", ch: ch1, query: data.Query{ID: 1, OrderBy: "key"}},
+		{ref: "/path", ch: ch2, query: data.Query{ID: 2, OrderBy: "key"}},
+		{ref: "/path", ch: ch2, query: data.Query{ID: 3, OrderBy: "value"}},
+		{ref: "/path2", ch: ch1, query: data.Query{ID: 4, OrderBy: "key"}},
+	}
+
+	v := views(subs)
+	assert.Len(t, v, 3)
+	assertContainsOnly(t, v[view{ref: "/path", query: data.Query{OrderBy: "key"}}], subs[0], subs[1])
+	assertContainsOnly(t, v[view{ref: "/path", query: data.Query{OrderBy: "value"}}], subs[2])
+	assertContainsOnly(t, v[view{ref: "/path2", query: data.Query{OrderBy: "key"}}], subs[3])
+}
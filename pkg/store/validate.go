@@ -0,0 +1,114 @@
+package store
+
+import (
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+)
+
+// maxKeyLength defines the max length of a key in bytes.
+const maxKeyLength = 768
+
+// validateKey checks the key is non-empty and contains no forbidden characters,
+// which are ".", "$", "#", "[", "]", "/" and ASCII control characters.
+func validateKey(key string) error {
+	if key == "" {
+		return data.Errorf(data.KindInvalid, "invalid key: empty key")
+	}
+	if len(key) > maxKeyLength {
+		return data.Errorf(data.KindInvalid, "invalid key %s: longer than %d bytes", truncate(key, 32)+"...", maxKeyLength)
+	}
+	if strings.ContainsAny(key, ".$#[]/") || strings.IndexFunc(key, func(r rune) bool { return r < 32 || r == 127 }) >= 0 {
+		return data.Errorf(data.KindInvalid, "invalid key %q: cannot contain \".\", \"$\", \"#\", \"[\", \"]\", \"/\" or control characters", key)
+	}
+	return nil
+}
+
+// truncate returns the prefix of string within n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// validateRef checks every segment of the reference is a valid key, except the
+// priority of a node.
+func validateRef(ref string) error {
+	segs := segments(ref)
+	for i, segment := range segs {
+		if i > 0 && i == len(segs)-1 && segment == data.PriorityKey {
+			continue
+		}
+		if err := validateKey(segment); err != nil {
+			return data.Wrapf(err, "invalid path %s", ref)
+		}
+	}
+	return nil
+}
+
+// validatePriority checks the priority is a number or string.
+func validatePriority(priority interface{}) error {
+	switch priority.(type) {
+	case nil, string, float64, int, int64:
+		return nil
+	}
+	return data.Errorf(data.KindInvalid, "invalid priority %v: should be a number or string", priority)
+}
+
+// validateData checks the keys of data recursively including the elements of arrays,
+// the data can carry priorities by ".priority" and ".value".
+func validateData(value interface{}) error {
+	if a, ok := value.([]interface{}); ok {
+		for _, v := range a {
+			if err := validateData(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if err := validatePriority(m[data.PriorityKey]); err != nil {
+		return err
+	}
+	if v, ok := m[data.ValueKey]; ok {
+		_, isMap := v.(map[string]interface{})
+		for k := range m {
+			if isMap || (k != data.ValueKey && k != data.PriorityKey) {
+				return data.Errorf(data.KindInvalid, "invalid data: \".value\" should be a leaf with only \".priority\"")
+			}
+		}
+		return nil
+	}
+	for k, v := range m {
+		if k == data.PriorityKey {
+			continue
+		}
+		if err := validateKey(k); err != nil {
+			return err
+		}
+		if err := validateData(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateWrite checks the reference and the keys of data to write.
+func validateWrite(ref string, value interface{}) error {
+	if err := validateRef(ref); err != nil {
+		return err
+	}
+	if path.Base(ref) == data.PriorityKey {
+		return validatePriority(value)
+	}
+	return validateData(value)
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/IguteChung/flakbase/pkg/data"
+	"github.com/IguteChung/flakbase/pkg/db"
+)
+
+// window defines the cached result of a limit or range query, which is maintained
+// by the changed children and only re-queried if a child may enter or leave it.
+type window struct {
+	sync.Mutex
+	query data.Query
+	// children defines the children in window, nil if not evaluated yet.
+	children map[string]interface{}
+}
+
+// seed initiates the window with the query result if not evaluated yet.
+func (w *window) seed(resp interface{}) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.children == nil {
+		w.children = copyChildren(resp)
+	}
+}
+
+// better returns true if a child ranks closer to the limit side than another one.
+func (w *window) better(key1 string, index1 interface{}, key2 string, index2 interface{}) bool {
+	if w.query.LimitOrder == "l" {
+		return w.query.Less(key1, index1, key2, index2)
+	}
+	return w.query.Less(key2, index2, key1, index1)
+}
+
+// worst returns the child on the boundary of a full window excluding the key, found
+// is false if the window is not full.
+func (w *window) worst(exclude string) (key string, index interface{}, found bool) {
+	if w.query.Limit == 0 || len(w.children) < w.query.Limit {
+		return "", nil, false
+	}
+	for k, v := range w.children {
+		if k == exclude {
+			continue
+		}
+		if i := w.query.Index(k, v); !found || w.better(key, index, k, i) {
+			key, index, found = k, i, true
+		}
+	}
+	return key, index, found
+}
+
+// update evaluates the updated references under ref and returns the changes to send,
+// merge is false if the changes replace the whole data. It should be called with lock.
+func (w *window) update(ctx context.Context, client db.Client, ref string, updatedRefs []string) (changes interface{}, merge bool, err error) {
+	// find the changed children, re-query if the whole reference changed.
+	changed := map[string]bool{}
+	requery := w.children == nil || len(updatedRefs) == 0
+	refPath := strings.TrimSuffix(ref, "/") + "/"
+	for _, updatedRef := range updatedRefs {
+		updatedRefPath := strings.TrimSuffix(updatedRef, "/") + "/"
+		if strings.HasPrefix(refPath, updatedRefPath) {
+			requery = true
+		} else if strings.HasPrefix(updatedRefPath, refPath) {
+			changed[strings.SplitN(strings.TrimPrefix(updatedRefPath, refPath), "/", 2)[0]] = true
+		}
+	}
+	if requery {
+		return w.requery(ctx, client, ref)
+	}
+
+	// work on a copy, the window is restored before re-query since the client
+	// has not received any change.
+	children := w.children
+	w.children = copyChildren(children)
+	restore := func() (interface{}, bool, error) {
+		w.children = children
+		return w.requery(ctx, client, ref)
+	}
+
+	delta := map[string]interface{}{}
+	for key := range changed {
+		value, err := client.Get(ctx, path.Join(ref, key), data.Query{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get %s: %v", key, err)
+		}
+		index := w.query.Index(key, value)
+		in := value != nil && w.query.Within(key, index)
+		old, was := w.children[key]
+
+		switch {
+		case !was && !in:
+			// irrelevant to window.
+			continue
+		case w.query.Limit == 0:
+			// no boundary for a range query.
+		case was && in:
+			// the child stays if still ranks before the boundary of others.
+			if k, i, found := w.worst(key); found && w.better(k, i, key, index) {
+				return restore()
+			}
+		case was && !in:
+			// the child leaves, another child may enter a full window.
+			if len(w.children) >= w.query.Limit {
+				return restore()
+			}
+		case !was && in:
+			// the child enters a full window only if ranks before the boundary.
+			if k, i, found := w.worst(""); found {
+				if w.better(k, i, key, index) {
+					continue
+				}
+				return restore()
+			}
+		}
+
+		if !in {
+			delete(w.children, key)
+			delta[key] = nil
+		} else if !reflect.DeepEqual(old, value) {
+			w.children[key] = value
+			delta[key] = value
+		}
+	}
+
+	if len(delta) == 0 {
+		return nil, true, nil
+	}
+	return delta, true, nil
+}
+
+// requery evaluates the whole query and returns the differences with the window.
+func (w *window) requery(ctx context.Context, client db.Client, ref string) (interface{}, bool, error) {
+	resp, err := client.Get(ctx, ref, w.query)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get %s: %v", ref, err)
+	}
+
+	// replace the whole data if not comparable.
+	children := copyChildren(resp)
+	if w.children == nil || children == nil {
+		w.children = children
+		return resp, false, nil
+	}
+
+	delta := map[string]interface{}{}
+	for k, v := range children {
+		if old, ok := w.children[k]; !ok || !reflect.DeepEqual(old, v) {
+			delta[k] = v
+		}
+	}
+	for k := range w.children {
+		if _, ok := children[k]; !ok {
+			delta[k] = nil
+		}
+	}
+	w.children = children
+	if len(delta) == 0 {
+		return nil, true, nil
+	}
+	return delta, true, nil
+}
+
+// copyChildren copies the children of a query result, nil if not a map.
+func copyChildren(resp interface{}) map[string]interface{} {
+	m, ok := resp.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	children := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		children[k] = v
+	}
+	return children
+}